@@ -28,10 +28,14 @@ func runTask(input string, outdir string) {
 	if getFlagBool("epub2") {
 		ver = EPUB_VERSION_200
 	}
+	maker.SetReproducible(getFlagBool("reproducible"))
 	if folder, tr.e = OpenVirtualFolder(input); tr.e != nil {
 		logger.Printf("%s: failed to open source folder/file.\n", input)
-	} else if tr.e = maker.Process(folder, duokan); tr.e == nil {
-		tr.e = maker.SaveTo(outdir, ver)
+	} else {
+		if tr.e = maker.Process(folder, duokan); tr.e == nil {
+			tr.e = maker.SaveTo(outdir, ver)
+		}
+		folder.Close()
 	}
 
 	chTaskResult <- tr
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
@@ -14,17 +15,19 @@ type Config struct {
 }
 
 func ParseIni(reader io.Reader) (*Config, error) {
+	data, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return nil, e
+	}
+	if data, e = decodeText(data, ""); e != nil {
+		return nil, e
+	}
+
 	section, lastKey, cfg := "/", "", make(map[string]string)
-	firstLine, scanner := true, bufio.NewScanner(reader)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 
 	for scanner.Scan() {
-		s := scanner.Bytes()
-		if firstLine {
-			s = removeUtf8Bom(s)
-			firstLine = false
-		}
-
-		s = bytes.TrimSpace(s)
+		s := bytes.TrimSpace(scanner.Bytes())
 		if len(s) == 0 || s[0] == '#' { // empty or comment
 			continue
 		}
@@ -83,6 +86,12 @@ func OpenIniFile(path string) (*Config, error) {
 	return ParseIni(f)
 }
 
+// Lookup returns the value at 'path', and whether it exists
+func (cfg *Config) Lookup(path string) (string, bool) {
+	v, ok := cfg.data[strings.ToLower(path)]
+	return v, ok
+}
+
 func (cfg *Config) GetInt(path string, dflt int) int {
 	path = strings.ToLower(path)
 	if v, ok := cfg.data[path]; ok {
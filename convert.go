@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/net/html/atom"
+)
+
+// dropCoverPage removes the cover page from the book, because a new one is
+// generated for the cover image. The cover page should be the first page.
+func dropCoverPage(book *Epub) error {
+	f := book.firstContentFile()
+	if f == nil {
+		return nil
+	}
+	rc, e := f.Open()
+	if e != nil {
+		return e
+	}
+	data, e := ioutil.ReadAll(rc)
+	rc.Close()
+	if e != nil {
+		return e
+	}
+	doc, e := parseXhtml(data)
+	if e != nil {
+		return e
+	}
+	if body := findFirstChild(doc, atom.Body); body != nil && isCoverPage(book.cover, f.Path, body) {
+		f.Attr = epub_INTERNAL_FILE
+		f.Chapters = nil
+	}
+	return nil
+}
+
+// convertEpub converts EPUB file 'inpath' to 'version' and writes the result
+// to 'w'. The package documents are regenerated, and all other files are
+// kept as is.
+func convertEpub(inpath string, version int, w io.Writer) error {
+	folder, e := OpenZipFolder(inpath)
+	if e != nil {
+		return e
+	}
+	defer folder.Close()
+
+	pkg, e := readEpub(folder)
+	if e != nil {
+		return e
+	}
+	book := pkg.book
+
+	for _, f := range book.files {
+		if (f.Attr & epub_FULL_SCREEN_PAGE) != 0 {
+			book.duokan = true
+		}
+	}
+	if cover := pkg.coverPath(); len(cover) > 0 {
+		book.SetCoverImage(cover)
+		if e = dropCoverPage(book); e != nil {
+			return e
+		}
+	}
+
+	paths := make(map[string]bool)
+	files := book.files[:0]
+	for _, f := range book.files {
+		// the old navigation document and NCX are replaced by new ones
+		if (f.Attr&epub_INTERNAL_FILE) != 0 || f.mediaType() == "application/x-dtbncx+xml" {
+			continue
+		}
+		switch strings.ToLower(f.Path) {
+		case path_of_content_opf, path_of_toc_ncx, path_of_nav_xhtml, path_of_cover_page, strings.ToLower(path_of_container_xml):
+			return fmt.Errorf("'%s' conflicts with a generated file", f.Path)
+		}
+		paths[f.Path] = true
+		files = append(files, f)
+	}
+	book.files = files
+
+	// files in 'META-INF' other than 'container.xml', like 'encryption.xml',
+	// are copied verbatim, they are not in the manifest
+	e = folder.Walk(func(p string) error {
+		if strings.HasPrefix(p, "META-INF/") && p != path_of_container_xml && !strings.HasSuffix(p, "/") && !paths[p] {
+			book.files = append(book.files, &File{Path: p, Attr: epub_INTERNAL_FILE, folder: folder})
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	return book.BuildTo(w, version)
+}
+
+func RunConvert() {
+	ver, inpath, outpath := getArg(0, ""), getArg(1, ""), getArg(2, "")
+	if len(inpath) == 0 {
+		onCommandLineError()
+	}
+
+	version := EPUB_VERSION_NONE
+	switch strings.ToLower(ver) {
+	case "epub2":
+		version = EPUB_VERSION_200
+	case "epub3":
+		version = EPUB_VERSION_300
+	default:
+		onCommandLineError()
+	}
+
+	if len(outpath) == 0 {
+		outpath = inpath
+	}
+	e := replaceFile(outpath, func(w io.Writer) error {
+		return convertEpub(inpath, version, w)
+	})
+	if e != nil {
+		logger.Fatalf("failed to convert '%s': %s\n", inpath, e.Error())
+	}
+}
+
+func init() {
+	AddCommandHandler("convert", RunConvert)
+}
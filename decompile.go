@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// 'url(...)' in style sheets
+	css_url = regexp.MustCompile(`url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+)
+
+// a content file which is merged into book.html
+type decompiledPage struct {
+	file       *File
+	head       *html.Node
+	body       *html.Node
+	fullscreen *html.Node // the image if this is a full screen image page
+}
+
+type decompiler struct {
+	pkg       *epubPackage
+	outdir    string
+	base      string // folder of the OPF, which is removed from resource paths
+	cover     string // path of the cover image in the package
+	covername string // name of the cover image in the output folder
+	pages     []*decompiledPage
+	merged    map[string]bool              // paths of files merged into book.html
+	dropped   map[string]bool              // paths of the cover pages
+	ids       map[string]map[string]string // new ids of elements, by file
+	used      map[string]bool              // ids used in book.html
+	markers   map[string]string            // ids of the markers at file beginnings
+	styles    map[string]bool              // style sheets added to book.html
+	head      *html.Node
+	toc       int // the lowest level of the table of content
+	failed    int
+}
+
+// newPath returns the path of a resource in the output folder
+func (this *decompiler) newPath(p string) string {
+	if p == this.cover && len(this.covername) > 0 {
+		return this.covername
+	}
+	if len(this.base) > 0 && strings.HasPrefix(p, this.base+"/") {
+		return p[len(this.base)+1:]
+	}
+	return p
+}
+
+// rewriteUrl converts 'href' in file 'base' into a link in book.html, links
+// to merged files become fragment-only links.
+func (this *decompiler) rewriteUrl(base, href string) string {
+	p, frag := resolveHref(base, href)
+	if len(p) == 0 {
+		return href
+	}
+	if this.merged[p] {
+		if len(frag) == 0 {
+			return "#" + this.markers[p]
+		}
+		if id, ok := this.ids[p][frag]; ok {
+			return "#" + id
+		}
+		return "#" + frag
+	}
+	u := url.URL{Path: this.newPath(p), Fragment: frag}
+	return u.String()
+}
+
+func (this *decompiler) rewriteCss(base, css string) string {
+	return css_url.ReplaceAllStringFunc(css, func(s string) string {
+		m := css_url.FindStringSubmatch(s)
+		return "url(" + m[1] + this.rewriteUrl(base, m[2]) + m[3] + ")"
+	})
+}
+
+func (this *decompiler) uniqueId(id string) string {
+	base := id
+	for i := 1; this.used[id]; i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	this.used[id] = true
+	return id
+}
+
+// fullScreenImage returns the image of a full screen image page
+func fullScreenImage(body *html.Node) *html.Node {
+	if len(strings.TrimSpace(nodeText(body))) > 0 {
+		return nil
+	}
+	if imgs := findChildren(body, atom.Img); len(imgs) == 1 {
+		return imgs[0]
+	}
+	return nil
+}
+
+func (this *decompiler) loadPages() error {
+	fullscreen := make(map[string]bool)
+	for _, ir := range this.pkg.opf.Spine.ItemRefs {
+		if item := this.pkg.findItem(ir.IdRef); item != nil {
+			fullscreen[this.pkg.itemPath(item)] = containsField(ir.Properties, "duokan-page-fullscreen")
+		}
+	}
+
+	for _, f := range this.pkg.book.files {
+		if (f.Attr&epub_CONTENT_FILE) == 0 || (f.Attr&epub_INTERNAL_FILE) != 0 {
+			continue
+		}
+		if mt := getMediaType(f.Path); mt != "application/xhtml+xml" && mt != "text/html" {
+			continue
+		}
+
+		rc, e := f.Open()
+		if e != nil {
+			return e
+		}
+		data, e := ioutil.ReadAll(rc)
+		rc.Close()
+		if e != nil {
+			return e
+		}
+		doc, e := parseXhtml(data)
+		if e != nil {
+			return fmt.Errorf("failed to parse '%s': %s", f.Path, e.Error())
+		}
+
+		Html := findFirstDirectChild(doc, atom.Html)
+		pg := &decompiledPage{
+			file: f,
+			head: findFirstDirectChild(Html, atom.Head),
+			body: findFirstDirectChild(Html, atom.Body),
+		}
+		if pg.body == nil {
+			continue
+		}
+		if isCoverPage(this.cover, f.Path, pg.body) {
+			this.dropped[f.Path] = true
+			continue
+		}
+		if fullscreen[f.Path] {
+			pg.fullscreen = fullScreenImage(pg.body)
+		}
+		this.pages = append(this.pages, pg)
+		this.merged[f.Path] = true
+	}
+
+	return nil
+}
+
+// assignIds makes ids of elements unique in book.html, and assigns ids for
+// the beginning of every file.
+func (this *decompiler) assignIds() {
+	for _, pg := range this.pages {
+		ids := make(map[string]string)
+		forEachElement(pg.body, func(node *html.Node) {
+			attr := findAttribute(node, "id")
+			if attr == nil || len(attr.Val) == 0 {
+				return
+			}
+			if id, ok := ids[attr.Val]; ok {
+				attr.Val = id
+				return
+			}
+			id := this.uniqueId(attr.Val)
+			ids[attr.Val] = id
+			attr.Val = id
+		})
+		this.ids[pg.file.Path] = ids
+	}
+
+	for i, pg := range this.pages {
+		if pg.fullscreen != nil {
+			if attr := findAttribute(pg.fullscreen, "id"); attr != nil && len(attr.Val) > 0 {
+				this.markers[pg.file.Path] = attr.Val
+				continue
+			}
+		}
+		this.markers[pg.file.Path] = this.uniqueId(fmt.Sprintf("file-%d", i))
+	}
+}
+
+// rewritePage rewrites links of a page, and collects its style sheets
+func (this *decompiler) rewritePage(pg *decompiledPage) {
+	p := pg.file.Path
+	forEachElement(pg.body, func(node *html.Node) {
+		// split points of the original html are meaningless now
+		removeClass(node, makeepub_chapter)
+		removeAttribute(node, data_chapter_level)
+		removeAttribute(node, data_chapter_title)
+		for i := range node.Attr {
+			attr := &node.Attr[i]
+			switch attr.Key {
+			case "href", "src", "poster":
+				attr.Val = this.rewriteUrl(p, attr.Val)
+			case "data":
+				if node.DataAtom == atom.Object {
+					attr.Val = this.rewriteUrl(p, attr.Val)
+				}
+			case "style":
+				attr.Val = this.rewriteCss(p, attr.Val)
+			}
+		}
+		if node.DataAtom == atom.Style && node.FirstChild != nil {
+			node.FirstChild.Data = this.rewriteCss(p, node.FirstChild.Data)
+		}
+	})
+
+	if pg.head == nil {
+		return
+	}
+	for node := pg.head.FirstChild; node != nil; node = node.NextSibling {
+		if node.DataAtom == atom.Link && containsField(strings.ToLower(getAttributeValue(node, "rel", "")), "stylesheet") {
+			href := this.rewriteUrl(p, getAttributeValue(node, "href", ""))
+			if !this.styles[href] {
+				this.styles[href] = true
+				this.head.AppendChild(newElement(atom.Link,
+					html.Attribute{Key: "href", Val: href},
+					html.Attribute{Key: "type", Val: "text/css"},
+					html.Attribute{Key: "rel", Val: "stylesheet"},
+				))
+				this.head.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+			}
+		} else if node.DataAtom == atom.Style && node.FirstChild != nil {
+			css := this.rewriteCss(p, node.FirstChild.Data)
+			if !this.styles[css] {
+				this.styles[css] = true
+				style := newElement(atom.Style)
+				style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+				this.head.AppendChild(style)
+				this.head.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+			}
+		}
+	}
+}
+
+// markChapter makes 'node' a split point of 'level' with 'title'
+func markChapter(node *html.Node, level int, title string) {
+	addClass(node, makeepub_chapter)
+	removeAttribute(node, data_chapter_level)
+	removeAttribute(node, data_chapter_title)
+	node.Attr = append(node.Attr,
+		html.Attribute{Key: data_chapter_level, Val: fmt.Sprint(level)},
+		html.Attribute{Key: data_chapter_title, Val: title},
+	)
+}
+
+func (this *decompiler) newMarker(level int, title, id string) *html.Node {
+	div := newElement(atom.Div, html.Attribute{Key: "id", Val: id})
+	markChapter(div, level, title)
+	return div
+}
+
+// findTopLevel returns the ancestor of 'node' which is a child of 'body'
+func findTopLevel(body, node *html.Node) *html.Node {
+	for node != nil && node.Parent != body {
+		node = node.Parent
+	}
+	return node
+}
+
+// mergePage moves the content of a page into 'body' of book.html, a level
+// 0 split point is added to its beginning, and the chapters are marked.
+func (this *decompiler) mergePage(pg *decompiledPage, body *html.Node) {
+	p := pg.file.Path
+	nl := func() *html.Node { return &html.Node{Type: html.TextNode, Data: "\n"} }
+
+	if img := pg.fullscreen; img != nil {
+		img.Parent.RemoveChild(img)
+		removeAttribute(img, "id")
+		img.Attr = append(img.Attr, html.Attribute{Key: "id", Val: this.markers[p]})
+		addClass(img, duokan_fullscreen)
+		if len(pg.file.Chapters) > 0 {
+			c := pg.file.Chapters[0]
+			markChapter(img, c.Level, c.Title)
+		}
+		body.AppendChild(img)
+		body.AppendChild(nl())
+		return
+	}
+
+	body.AppendChild(this.newMarker(0, "", this.markers[p]))
+	body.AppendChild(nl())
+
+	ids := this.ids[p]
+	for _, c := range pg.file.Chapters {
+		var target *html.Node
+		if frag := strings.TrimPrefix(c.Link, "#"); len(frag) > 0 {
+			id := frag
+			if s, ok := ids[frag]; ok {
+				id = s
+			}
+			forEachElement(pg.body, func(node *html.Node) {
+				if target == nil && getAttributeValue(node, "id", "") == id {
+					target = node
+				}
+			})
+		}
+
+		if target == nil {
+			body.AppendChild(this.newMarker(c.Level, c.Title, this.uniqueId("toc")))
+			body.AppendChild(nl())
+			continue
+		}
+
+		top := findTopLevel(pg.body, target)
+		if top == target && top.Type == html.ElementNode && !hasClass(top, makeepub_chapter) {
+			markChapter(top, c.Level, c.Title)
+		} else {
+			pg.body.InsertBefore(this.newMarker(c.Level, c.Title, this.uniqueId("toc")), top)
+		}
+	}
+
+	for node := pg.body.FirstChild; node != nil; node = pg.body.FirstChild {
+		pg.body.RemoveChild(node)
+		body.AppendChild(node)
+	}
+	body.AppendChild(nl())
+}
+
+func (this *decompiler) writeBookHtml() error {
+	book := this.pkg.book
+	this.head = newElement(atom.Head)
+	this.head.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+	this.head.AppendChild(newElement(atom.Meta, html.Attribute{Key: "charset", Val: "utf-8"}))
+	this.head.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+	title := newElement(atom.Title)
+	title.AppendChild(&html.Node{Type: html.TextNode, Data: book.Name()})
+	this.head.AppendChild(title)
+	this.head.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+
+	body := newElement(atom.Body)
+	body.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+	for _, pg := range this.pages {
+		this.rewritePage(pg)
+	}
+	for _, pg := range this.pages {
+		for _, c := range pg.file.Chapters {
+			if c.Level > this.toc {
+				this.toc = c.Level
+			}
+		}
+		this.mergePage(pg, body)
+	}
+
+	Html := newElement(atom.Html)
+	if lang := book.Language(); len(lang) > 0 {
+		Html.Attr = append(Html.Attr, html.Attribute{Key: "lang", Val: lang})
+	}
+	Html.AppendChild(this.head)
+	Html.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+	Html.AppendChild(body)
+
+	doc := &html.Node{Type: html.DocumentNode}
+	doc.AppendChild(&html.Node{Type: html.DoctypeNode, Data: "html"})
+	doc.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+	doc.AppendChild(Html)
+
+	buf := new(bytes.Buffer)
+	if e := html.Render(buf, doc); e != nil {
+		return e
+	}
+	return ioutil.WriteFile(filepath.Join(this.outdir, "book.html"), buf.Bytes(), 0644)
+}
+
+// writeIniValue writes an option of book.ini, lines of a multi-line value
+// begin with '='.
+func writeIniValue(buf *bytes.Buffer, key, value string) {
+	if value = strings.TrimSpace(value); len(value) == 0 {
+		return
+	}
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if i == 0 {
+			buf.WriteString(key + "=" + line + "\n")
+		} else {
+			buf.WriteString(strings.Repeat(" ", len(key)) + "=" + line + "\n")
+		}
+	}
+}
+
+func formatCreator(c Creator) string {
+	s := c.Name + " | " + c.Role
+	if len(c.FileAs) > 0 {
+		s += " | " + c.FileAs
+	}
+	return s
+}
+
+func (this *decompiler) writeBookIni(name string) error {
+	book := this.pkg.book
+	buf := new(bytes.Buffer)
+
+	buf.WriteString("[book]\n")
+	writeIniValue(buf, "name", book.Name())
+
+	author, n := -1, 1
+	for i, c := range book.Creators() {
+		if c.Role == "aut" && author < 0 {
+			author = i
+			writeIniValue(buf, "author", c.Name)
+			writeIniValue(buf, "AuthorFileAs", c.FileAs)
+		}
+	}
+	for i, c := range book.Creators() {
+		if i != author && len(c.Name) > 0 {
+			writeIniValue(buf, fmt.Sprintf("creator%d", n), formatCreator(c))
+			n++
+		}
+	}
+	n = 1
+	for _, c := range book.Contributors() {
+		if len(c.Name) > 0 {
+			writeIniValue(buf, fmt.Sprintf("contributor%d", n), formatCreator(c))
+			n++
+		}
+	}
+
+	writeIniValue(buf, "id", book.Id())
+	writeIniValue(buf, "publisher", book.Publisher())
+	writeIniValue(buf, "description", book.Description())
+	writeIniValue(buf, "language", book.Language())
+	writeIniValue(buf, "subjects", strings.Join(book.Subjects(), ", "))
+	writeIniValue(buf, "series", book.Series())
+	writeIniValue(buf, "SeriesIndex", book.SeriesIndex())
+	writeIniValue(buf, "rights", book.Rights())
+	writeIniValue(buf, "source", book.Source())
+	writeIniValue(buf, "date", book.Date())
+	if this.toc < 1 {
+		this.toc = 1
+	}
+	writeIniValue(buf, "toc", fmt.Sprint(this.toc))
+
+	// every file begins with a level 0 split point, and headers are not
+	// split points, so the original files and chapters are restored.
+	buf.WriteString("\n[split]\nAtLevel=0\nByHeader=7\n")
+	buf.WriteString("\n[output]\n")
+	writeIniValue(buf, "path", name)
+
+	return ioutil.WriteFile(filepath.Join(this.outdir, "book.ini"), buf.Bytes(), 0644)
+}
+
+func (this *decompiler) copyFile(f *File, name string) error {
+	target, e := extractPath(this.outdir, name)
+	if e != nil {
+		return e
+	}
+	if e = os.MkdirAll(filepath.Dir(target), 0755); e != nil {
+		return e
+	}
+
+	rc, e := f.Open()
+	if e != nil {
+		return e
+	}
+	defer rc.Close()
+
+	out, e := os.Create(target)
+	if e != nil {
+		return e
+	}
+	if _, e = io.Copy(out, rc); e != nil {
+		out.Close()
+		return e
+	}
+	return out.Close()
+}
+
+// copyResources copies files which are not merged into book.html
+func (this *decompiler) copyResources() {
+	for _, f := range this.pkg.book.files {
+		if this.merged[f.Path] || this.dropped[f.Path] || (f.Attr&epub_INTERNAL_FILE) != 0 {
+			continue
+		}
+		if e := this.copyFile(f, this.newPath(f.Path)); e != nil {
+			logger.Printf("failed to copy '%s': %s.\n", f.Path, e.Error())
+			this.failed++
+		}
+	}
+}
+
+func decompileEpub(inpath, outdir string) (int, error) {
+	folder, e := OpenZipFolder(inpath)
+	if e != nil {
+		return 0, e
+	}
+	defer folder.Close()
+
+	pkg, e := readEpub(folder)
+	if e != nil {
+		return 0, e
+	}
+
+	this := &decompiler{
+		pkg:     pkg,
+		outdir:  outdir,
+		cover:   pkg.coverPath(),
+		merged:  make(map[string]bool),
+		dropped: make(map[string]bool),
+		ids:     make(map[string]map[string]string),
+		used:    make(map[string]bool),
+		markers: make(map[string]string),
+		styles:  make(map[string]bool),
+	}
+	if this.base = path.Dir(pkg.opfPath); this.base == "." {
+		this.base = ""
+	}
+	if ext := strings.ToLower(path.Ext(this.cover)); ext == ".jpeg" || ext == ".jpg" {
+		this.covername = "cover.jpg"
+	} else if ext == ".png" || ext == ".gif" {
+		this.covername = "cover" + ext
+	} else if len(this.cover) > 0 {
+		logger.Printf("cover image '%s' is not supported, copied as a normal file.\n", this.cover)
+		this.cover = ""
+	}
+
+	if e = os.MkdirAll(outdir, 0755); e != nil {
+		return 0, e
+	}
+	if e = this.loadPages(); e != nil {
+		return 0, e
+	}
+	this.assignIds()
+	if e = this.writeBookHtml(); e != nil {
+		return 0, e
+	}
+
+	name := strings.TrimSuffix(filepath.Base(inpath), filepath.Ext(inpath)) + ".epub"
+	if e = this.writeBookIni(name); e != nil {
+		return 0, e
+	}
+	this.copyResources()
+
+	return this.failed, nil
+}
+
+func RunDecompile() {
+	inpath, outpath := getArg(0, ""), getArg(1, "")
+	if len(inpath) == 0 || len(outpath) == 0 {
+		onCommandLineError()
+	}
+
+	failed, e := decompileEpub(inpath, outpath)
+	if e != nil {
+		logger.Fatalf("failed to decompile '%s': %s\n", inpath, e.Error())
+	}
+	if failed > 0 {
+		logger.Fatalf("%d file(s) failed to copy.\n", failed)
+	}
+}
+
+func init() {
+	AddCommandHandler("d", RunDecompile)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	// size of the data used to detect the encoding
+	detect_sample_size = 64 * 1024
+
+	// the most frequently used characters of Chinese (both simplified and
+	// traditional) and Japanese, used to tell which encoding makes sense
+	common_chars = "的一是了不在人有我他這这個个們们中來来上大為为和國国地到以說说" +
+		"時时要就出會会可也你對对生能而子那得於于着著下自之年過过發发後后作裡里" +
+		"她道麼么去心看起還还好都沒没然" +
+		"のにはをたがでてとしれさあるないうかっ" +
+		"，。、「」：？！"
+)
+
+var (
+	common_char_set = make(map[rune]bool)
+
+	detect_candidates = []encoding.Encoding{
+		simplifiedchinese.GB18030,
+		traditionalchinese.Big5,
+		japanese.ShiftJIS,
+		unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+		unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	}
+)
+
+func init() {
+	for _, r := range common_chars {
+		common_char_set[r] = true
+	}
+}
+
+// detectUtf16 checks the distribution of zero bytes, which are very common
+// in UTF-16 text of western languages but rare in text of other encodings.
+func detectUtf16(data []byte) encoding.Encoding {
+	even, odd := 0, 0
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 {
+			even++
+		}
+		if data[i+1] == 0 {
+			odd++
+		}
+	}
+	pairs := len(data) / 2
+	if pairs == 0 {
+		return nil
+	}
+	if odd*10 > pairs*3 && even*10 < pairs {
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	}
+	if even*10 > pairs*3 && odd*10 < pairs {
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+	return nil
+}
+
+// scoreEncoding decodes 'data' with 'enc' and returns the ratio of common
+// characters in non-ASCII characters, or -1 if 'data' is not valid.
+func scoreEncoding(data []byte, enc encoding.Encoding) float64 {
+	text, e := enc.NewDecoder().Bytes(data)
+	if e != nil {
+		return -1
+	}
+	total, common, invalid := 0, 0, 0
+	for _, r := range string(text) {
+		if r < 128 {
+			continue
+		}
+		total++
+		if r == utf8.RuneError {
+			invalid++
+		} else if common_char_set[r] {
+			common++
+		}
+	}
+	// allow a few invalid characters, the sample may end in the middle of
+	// a character
+	if invalid > 2 || total == 0 {
+		return -1
+	}
+	return float64(common) / float64(total)
+}
+
+// detectEncoding returns the encoding of 'data', nil means UTF-8.
+func detectEncoding(data []byte) encoding.Encoding {
+	if len(data) >= 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
+		return nil
+	}
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	}
+	if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	}
+
+	if len(data) > detect_sample_size {
+		data = data[:detect_sample_size]
+	}
+	if enc := detectUtf16(data); enc != nil {
+		return enc
+	}
+
+	valid := data
+	if len(data) == detect_sample_size {
+		// the last character may be truncated
+		for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid); i++ {
+			valid = valid[:len(valid)-1]
+		}
+	}
+	if utf8.Valid(valid) {
+		return nil
+	}
+
+	var result encoding.Encoding = nil
+	best := -1.0
+	for _, enc := range detect_candidates {
+		if score := scoreEncoding(data, enc); score > best {
+			result, best = enc, score
+		}
+	}
+	return result
+}
+
+// decodeText converts 'data' in encoding 'charset' to UTF-8, the encoding is
+// detected automatically if 'charset' is empty. The UTF-8 BOM is removed.
+func decodeText(data []byte, charset string) ([]byte, error) {
+	var enc encoding.Encoding = nil
+	var e error = nil
+	if charset = strings.TrimSpace(charset); len(charset) > 0 {
+		if enc, e = htmlindex.Get(charset); e != nil {
+			return nil, fmt.Errorf("unknown encoding '%s'.", charset)
+		}
+		if enc == encoding.Nop || enc == unicode.UTF8 {
+			enc = nil
+		}
+	} else {
+		enc = detectEncoding(data)
+	}
+
+	if enc != nil {
+		if data, e = enc.NewDecoder().Bytes(data); e != nil {
+			return nil, e
+		}
+	}
+	return removeUtf8Bom(data), nil
+}
+
+// fixMetaCharset updates the 'meta' elements which specify the encoding of an
+// html document, it is UTF-8 after conversion.
+func fixMetaCharset(root *html.Node) {
+	forEachElement(root, func(node *html.Node) {
+		if node.DataAtom != atom.Meta {
+			return
+		}
+		if attr := findAttribute(node, "charset"); attr != nil {
+			attr.Val = "utf-8"
+		}
+		if strings.ToLower(getAttributeValue(node, "http-equiv", "")) != "content-type" {
+			return
+		}
+		if attr := findAttribute(node, "content"); attr != nil {
+			attr.Val = "text/html; charset=utf-8"
+		}
+	})
+}
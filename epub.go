@@ -5,6 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,7 +20,9 @@ const (
 	path_of_nav_xhtml     = "nav.xhtml"
 	path_of_content_opf   = "content.opf"
 	path_of_container_xml = "META-INF/container.xml"
-	path_of_cover_page    = "cover.html"
+	path_of_cover_page    = "cover.xhtml"
+	path_of_toc_page      = "toc.xhtml"
+	id_of_cover_image     = "cover-image"
 
 	EPUB_VERSION_NONE = iota // no version, pack all raw files into a zip package
 	EPUB_VERSION_200         // epub version 2.0
@@ -27,6 +32,9 @@ const (
 	epub_CONTENT_FILE                 // content files: the chapters
 	epub_FULL_SCREEN_PAGE             // full screen pages in content
 	epub_INTERNAL_FILE                // internal file, generated automatically in most case
+	epub_NON_LINEAR_PAGE              // content pages not in the reading order, like notes
+	epub_TOC_PAGE                     // the generated page of table of contents
+	epub_TEMPLATE_PAGE                // pages generated from templates, like the title page
 )
 
 var (
@@ -60,19 +68,30 @@ func getMediaType(path string) string {
 // helper class, epub compressor
 
 type epubCompressor struct {
-	zip *zip.Writer
-	buf *bytes.Buffer
+	zip      *zip.Writer
+	modified time.Time // modification time of all entries
 }
 
-func (this *epubCompressor) init() error {
-	this.buf = new(bytes.Buffer)
-	this.zip = zip.NewWriter(this.buf)
-
-	header := &zip.FileHeader{
-		Name:   path_of_mimetype,
-		Method: zip.Store,
+// header creates the header of an entry, the time is only stored in the
+// MS-DOS fields, so there is no extra field and the output is stable.
+func (this *epubCompressor) header(path string, method uint16) *zip.FileHeader {
+	t := this.modified
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return &zip.FileHeader{
+		Name:         path,
+		Method:       method,
+		ModifiedDate: uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9),
+		ModifiedTime: uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11),
 	}
-	w, e := this.zip.CreateHeader(header)
+}
+
+func (this *epubCompressor) init(w io.Writer, modified time.Time) error {
+	this.zip = zip.NewWriter(w)
+	this.modified = modified
+
+	w, e := this.zip.CreateHeader(this.header(path_of_mimetype, zip.Store))
 	if e == nil {
 		_, e = w.Write([]byte("application/epub+zip"))
 	}
@@ -80,19 +99,29 @@ func (this *epubCompressor) init() error {
 }
 
 func (this *epubCompressor) addFile(path string, data []byte) error {
-	w, e := this.zip.Create(path)
+	w, e := this.zip.CreateHeader(this.header(path, zip.Deflate))
 	if e == nil {
 		_, e = w.Write(data)
 	}
 	return e
 }
 
-func (this *epubCompressor) close() error {
-	return this.zip.Close()
+// copyFile adds a file whose data is read from 'r'
+func (this *epubCompressor) copyFile(path string, r io.Reader) error {
+	w, e := this.zip.CreateHeader(this.header(path, zip.Deflate))
+	if e == nil {
+		_, e = io.Copy(w, r)
+	}
+	return e
 }
 
-func (this *epubCompressor) result() []byte {
-	return this.buf.Bytes()
+// copyEntry copies an entry of another zip file without decompressing it
+func (this *epubCompressor) copyEntry(zf *zip.File) error {
+	return this.zip.Copy(zf)
+}
+
+func (this *epubCompressor) close() error {
+	return this.zip.Close()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -104,22 +133,77 @@ type Chapter struct {
 }
 
 type File struct {
-	Path     string
-	Data     []byte
-	Attr     int
-	Chapters []Chapter
+	Path       string
+	Data       []byte
+	Attr       int
+	Chapters   []Chapter
+	MediaType  string        // if empty, it is detected from the extension of 'Path'
+	Properties string        // properties of the manifest item, EPUB3 only
+	folder     VirtualFolder // if not nil, data is read from 'Path' of it on demand
+}
+
+// mediaType returns the media type of the file
+func (this *File) mediaType() string {
+	if len(this.MediaType) > 0 {
+		return this.MediaType
+	}
+	return getMediaType(this.Path)
+}
+
+// properties returns the properties of the manifest item of the file, those
+// managed by the book itself are removed, 'cover-image' is added if 'cover'.
+func (this *File) properties(cover bool) string {
+	props := make([]string, 0, 4)
+	if cover {
+		props = append(props, "cover-image")
+	}
+	for _, p := range strings.Fields(this.Properties) {
+		if p != "cover-image" && p != "nav" {
+			props = append(props, p)
+		}
+	}
+	return strings.Join(props, " ")
+}
+
+// Open opens the data of the file for reading
+func (this *File) Open() (io.ReadCloser, error) {
+	if this.folder != nil {
+		return this.folder.OpenFile(this.Path)
+	}
+	return ioutil.NopCloser(bytes.NewReader(this.Data)), nil
+}
+
+// a creator or contributor of the book
+type Creator struct {
+	Name   string
+	Role   string // MARC relator code: 'aut' for author, 'trl' for translator...
+	FileAs string // the name for sorting, like 'Lu, Xun'
 }
 
 type Epub struct {
-	id          string
-	name        string
-	author      string
-	publisher   string
-	description string
-	language    string
-	cover       string // path of the cover image
-	duokan      bool   // if duokan externsion is enabled
-	files       []*File
+	id           string
+	name         string
+	creators     []Creator
+	contributors []Creator
+	publisher    string
+	description  string
+	language     string
+	subjects     []string
+	rights       string
+	source       string
+	date         string    // publication date
+	modified     time.Time // modification time, now if zero
+	series       string
+	series_index string
+	reproducible bool      // if the output should be the same for same input
+	epoch        time.Time // the fixed time of reproducible builds
+	cover        string    // path of the cover image
+	duokan       bool      // if duokan externsion is enabled
+	toc_title    string    // title of the generated TOC page
+	toc_depth    int       // depth of the generated TOC page, 0 for no TOC page
+	toc_styles   []string  // style sheets of the generated TOC page
+	templates    map[*File]*template.Template
+	files        []*File
 }
 
 func NewEpub(duokan bool) *Epub {
@@ -129,22 +213,51 @@ func NewEpub(duokan bool) *Epub {
 	return this
 }
 
+// Id returns the identifier of the book, it is generated if not specified.
+// For reproducible builds, the generated identifier is a UUID derived from
+// the metadata, so it must be called after all metadata are set.
 func (this *Epub) Id() string {
-	if len(this.id) == 0 {
-		this.SetId("")
+	if len(this.id) > 0 {
+		// nothing to do
+	} else if this.reproducible {
+		this.id = "urn:uuid:" + uuidV5(uuid_namespace_url, this.metadataKey())
+	} else {
+		h, _ := os.Hostname()
+		t := uint32(time.Now().Unix())
+		this.id = fmt.Sprintf("%s-book-%08x", h, t)
 	}
 	return this.id
 }
 
+// SetId sets the identifier of the book, it will be generated if 'id' is
+// empty.
 func (this *Epub) SetId(id string) {
-	if len(id) == 0 {
-		h, _ := os.Hostname()
-		t := uint32(time.Now().Unix())
-		id = fmt.Sprintf("%s-book-%08x", h, t)
-	}
 	this.id = id
 }
 
+// metadataKey returns a string which identifies the book by its metadata
+func (this *Epub) metadataKey() string {
+	fields := []string{"makeepub", this.name, this.language, this.publisher, this.date, this.series, this.series_index}
+	for _, c := range this.creators {
+		fields = append(fields, c.Role+":"+c.Name)
+	}
+	for _, c := range this.contributors {
+		fields = append(fields, c.Role+":"+c.Name)
+	}
+	return strings.Join(fields, "\x00")
+}
+
+// SetReproducible enables reproducible builds, 'epoch' is used for all the
+// timestamps, including the modification time if it is not set.
+func (this *Epub) SetReproducible(epoch time.Time) {
+	this.reproducible = true
+	this.epoch = epoch.UTC()
+}
+
+func (this *Epub) Reproducible() bool {
+	return this.reproducible
+}
+
 func (this *Epub) Name() string {
 	return this.name
 }
@@ -153,12 +266,47 @@ func (this *Epub) SetName(name string) {
 	this.name = name
 }
 
+// Author returns the name of the first author, or the first creator if there
+// is no author.
 func (this *Epub) Author() string {
-	return this.author
+	for _, c := range this.creators {
+		if c.Role == "aut" {
+			return c.Name
+		}
+	}
+	if len(this.creators) > 0 {
+		return this.creators[0].Name
+	}
+	return ""
 }
 
+// SetAuthor sets the name of the first author, an author is added if there
+// is no author.
 func (this *Epub) SetAuthor(author string) {
-	this.author = author
+	for i := range this.creators {
+		if this.creators[i].Role == "aut" {
+			this.creators[i].Name = author
+			return
+		}
+	}
+	c := Creator{Name: author, Role: "aut"}
+	this.creators = append([]Creator{c}, this.creators...)
+}
+
+func (this *Epub) Creators() []Creator {
+	return this.creators
+}
+
+func (this *Epub) AddCreator(c Creator) {
+	this.creators = append(this.creators, c)
+}
+
+func (this *Epub) Contributors() []Creator {
+	return this.contributors
+}
+
+func (this *Epub) AddContributor(c Creator) {
+	this.contributors = append(this.contributors, c)
 }
 
 func (this *Epub) Publisher() string {
@@ -185,6 +333,71 @@ func (this *Epub) SetLanguage(lang string) {
 	this.language = lang
 }
 
+func (this *Epub) Subjects() []string {
+	return this.subjects
+}
+
+func (this *Epub) AddSubject(subject string) {
+	this.subjects = append(this.subjects, subject)
+}
+
+func (this *Epub) Rights() string {
+	return this.rights
+}
+
+func (this *Epub) SetRights(rights string) {
+	this.rights = rights
+}
+
+func (this *Epub) Source() string {
+	return this.source
+}
+
+func (this *Epub) SetSource(source string) {
+	this.source = source
+}
+
+func (this *Epub) Date() string {
+	return this.date
+}
+
+// SetDate sets the publication date, in W3CDTF format 'YYYY', 'YYYY-MM',
+// 'YYYY-MM-DD' or 'YYYY-MM-DDThh:mm:ssZ'.
+func (this *Epub) SetDate(date string) {
+	this.date = date
+}
+
+// Modified returns the modification time, which is the epoch of reproducible
+// builds or the current time if not set.
+func (this *Epub) Modified() time.Time {
+	if !this.modified.IsZero() {
+		return this.modified
+	}
+	if this.reproducible {
+		return this.epoch
+	}
+	return time.Now().UTC()
+}
+
+func (this *Epub) SetModified(t time.Time) {
+	this.modified = t.UTC()
+}
+
+func (this *Epub) Series() string {
+	return this.series
+}
+
+func (this *Epub) SeriesIndex() string {
+	return this.series_index
+}
+
+// SetSeries sets the series the book belongs to, and its position in the
+// series, 'index' can be empty or a number like '2' or '2.5'.
+func (this *Epub) SetSeries(name, index string) {
+	this.series = name
+	this.series_index = index
+}
+
 func (this *Epub) Duokan() bool {
 	return this.duokan
 }
@@ -193,44 +406,78 @@ func (this *Epub) SetCoverImage(path string) {
 	this.cover = filepath.ToSlash(path)
 }
 
+// SetTocPage enables the generated TOC page if 'depth' is not 0, chapters
+// deeper than 'depth' are not listed in the page.
+func (this *Epub) SetTocPage(title string, depth int, stylesheets []string) {
+	this.toc_title = title
+	this.toc_depth = depth
+	this.toc_styles = stylesheets
+}
+
+// AddTocPage adds the TOC page before content file 'before', or to the end
+// if 'before' is nil. It does nothing if the TOC page is not enabled or has
+// already been added. The content of the page is generated when building.
+func (this *Epub) AddTocPage(before *File) {
+	if this.toc_depth == 0 || this.tocPage() != nil {
+		return
+	}
+	f := &File{Path: path_of_toc_page, Attr: epub_CONTENT_FILE | epub_TOC_PAGE}
+	this.insertFile(f, before)
+}
+
+// insertFile inserts 'f' before file 'before', or to the end if 'before' is
+// nil or not found.
+func (this *Epub) insertFile(f, before *File) {
+	for i, file := range this.files {
+		if file == before {
+			this.files = append(this.files[:i], append([]*File{f}, this.files[i:]...)...)
+			return
+		}
+	}
+	this.files = append(this.files, f)
+}
+
+func (this *Epub) tocPage() *File {
+	for _, f := range this.files {
+		if (f.Attr & epub_TOC_PAGE) != 0 {
+			return f
+		}
+	}
+	return nil
+}
+
 func (this *Epub) AddFile(path string, data []byte) {
-	path = filepath.ToSlash(path)
+	this.addFile(&File{Path: filepath.ToSlash(path), Data: data})
+}
+
+// AddFolderFile adds file 'path' of 'folder', its data is not read until the
+// book is written, so the folder must be kept open until then.
+func (this *Epub) AddFolderFile(folder VirtualFolder, path string) {
+	this.addFile(&File{Path: filepath.ToSlash(path), folder: folder})
+}
+
+func (this *Epub) addFile(f *File) {
+	path := f.Path
 	if strings.ToLower(path) == path_of_mimetype {
 		return
 	}
-	f := &File{
-		Path: path,
-		Data: data,
-	}
 	if path == path_of_cover_page ||
 		path == path_of_content_opf ||
 		path == path_of_toc_ncx ||
 		path == path_of_nav_xhtml ||
+		path == path_of_toc_page ||
+		path == path_of_title_page ||
+		path == path_of_copyright_page ||
+		path == path_of_colophon ||
 		path == strings.ToLower(path_of_container_xml) {
 		f.Attr = epub_INTERNAL_FILE
 	}
 	this.files = append(this.files, f)
 }
 
-func generateImagePage(path, alt string) []byte {
-	path = filepath.ToSlash(path)
-	s := fmt.Sprintf(""+
-		"<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
-		"<!DOCTYPE html>"+
-		"<html xmlns=\"http://www.w3.org/1999/xhtml\">\n"+
-		"<head>\n"+
-		"	<title></title>\n"+
-		"</head>\n"+
-		"<body>\n"+
-		"	<p><img alt=\"%s\" src=\"%s\"/></p>\n"+
-		"</body>\n"+
-		"</html>\n", alt, path)
-	return []byte(s)
-}
-
 func (this *Epub) AddFullScreenImage(path, alt string, chapters []Chapter) {
 	f := &File{
-		Path:     fmt.Sprintf("full_scrn_img_%04d.html", len(this.files)),
+		Path:     fmt.Sprintf("full_scrn_img_%04d.xhtml", len(this.files)),
 		Data:     generateImagePage(path, alt),
 		Attr:     epub_CONTENT_FILE | epub_FULL_SCREEN_PAGE,
 		Chapters: chapters,
@@ -238,14 +485,24 @@ func (this *Epub) AddFullScreenImage(path, alt string, chapters []Chapter) {
 	this.files = append(this.files, f)
 }
 
-func (this *Epub) AddChapter(chapters []Chapter, data []byte) {
+func (this *Epub) AddChapter(chapters []Chapter, data []byte) *File {
 	f := &File{
-		Path:     fmt.Sprintf("chapter_%04d.html", len(this.files)),
+		Path:     fmt.Sprintf("chapter_%04d.xhtml", len(this.files)),
 		Data:     data,
 		Attr:     epub_CONTENT_FILE,
 		Chapters: chapters,
 	}
 	this.files = append(this.files, f)
+	return f
+}
+
+func (this *Epub) firstContentFile() *File {
+	for _, f := range this.files {
+		if (f.Attr&epub_CONTENT_FILE) != 0 && (f.Attr&(epub_TOC_PAGE|epub_TEMPLATE_PAGE)) == 0 {
+			return f
+		}
+	}
+	return nil
 }
 
 func (this *Epub) Depth() int {
@@ -270,6 +527,31 @@ func (this *Epub) generateContainerXml() []byte {
 		"</container>")
 }
 
+// writeCreators writes 'dc:creator' or 'dc:contributor' elements, role and
+// file-as are attributes in EPUB2, but refinements in EPUB3.
+func writeCreators(buf *bytes.Buffer, version int, tag string, creators []Creator) {
+	for i, c := range creators {
+		if len(c.Name) == 0 {
+			continue
+		}
+		if version == EPUB_VERSION_200 {
+			fmt.Fprintf(buf, "		<dc:%s opf:role=\"%s\"", tag, html.EscapeString(c.Role))
+			if len(c.FileAs) > 0 {
+				fmt.Fprintf(buf, " opf:file-as=\"%s\"", html.EscapeString(c.FileAs))
+			}
+			fmt.Fprintf(buf, ">%s</dc:%s>\n", html.EscapeString(c.Name), tag)
+			continue
+		}
+
+		id := fmt.Sprintf("%s%d", tag, i+1)
+		fmt.Fprintf(buf, "		<dc:%s id=\"%s\">%s</dc:%s>\n", tag, id, html.EscapeString(c.Name), tag)
+		fmt.Fprintf(buf, "		<meta refines=\"#%s\" property=\"role\" scheme=\"marc:relators\">%s</meta>\n", id, html.EscapeString(c.Role))
+		if len(c.FileAs) > 0 {
+			fmt.Fprintf(buf, "		<meta refines=\"#%s\" property=\"file-as\">%s</meta>\n", id, html.EscapeString(c.FileAs))
+		}
+	}
+}
+
 func (this *Epub) generateContentOpf(version int) []byte {
 	buf := new(bytes.Buffer)
 
@@ -283,21 +565,57 @@ func (this *Epub) generateContentOpf(version int) []byte {
 
 	fmt.Fprintf(buf, "		<dc:identifier id=\"uuid_id\">%s</dc:identifier>\n"+
 		"		<dc:title>%s</dc:title>\n"+
-		"		<dc:language>%s</dc:language>\n"+
-		"		<meta name=\"cover\" content=\"%s\"/>\n",
+		"		<dc:language>%s</dc:language>\n",
 		html.EscapeString(this.Id()),
 		html.EscapeString(this.Name()),
 		html.EscapeString(this.Language()),
-		this.cover,
 	)
 
+	if len(this.cover) > 0 {
+		buf.WriteString("		<meta name=\"cover\" content=\"" + id_of_cover_image + "\"/>\n")
+	}
+
+	writeCreators(buf, version, "creator", this.creators)
+	writeCreators(buf, version, "contributor", this.contributors)
+
+	modified := this.Modified().Format(time.RFC3339)
 	if version == EPUB_VERSION_200 {
-		fmt.Fprintf(buf, "		<dc:creator opf:role=\"aut\">%s</dc:creator>\n", html.EscapeString(this.Author()))
-		fmt.Fprintf(buf, "		<dc:date>%s</dc:date>\n", time.Now().UTC().Format(time.RFC3339))
+		if len(this.date) > 0 {
+			fmt.Fprintf(buf, "		<dc:date opf:event=\"publication\">%s</dc:date>\n", html.EscapeString(this.date))
+		}
+		fmt.Fprintf(buf, "		<dc:date opf:event=\"modification\">%s</dc:date>\n", modified)
 	} else {
-		fmt.Fprintf(buf, "		<dc:creator id=\"creator\">%s</dc:creator>\n", html.EscapeString(this.Author()))
-		buf.WriteString("		<meta refines=\"#creator\" property=\"role\" scheme=\"marc:relators\" id=\"role\">aut</meta>\n")
-		fmt.Fprintf(buf, "		<meta property=\"dcterms:modified\">%s</meta>\n", time.Now().UTC().Format(time.RFC3339))
+		if len(this.date) > 0 {
+			fmt.Fprintf(buf, "		<dc:date>%s</dc:date>\n", html.EscapeString(this.date))
+		}
+		fmt.Fprintf(buf, "		<meta property=\"dcterms:modified\">%s</meta>\n", modified)
+	}
+
+	for _, subject := range this.subjects {
+		fmt.Fprintf(buf, "		<dc:subject>%s</dc:subject>\n", html.EscapeString(subject))
+	}
+
+	if len(this.rights) > 0 {
+		fmt.Fprintf(buf, "		<dc:rights>%s</dc:rights>\n", html.EscapeString(this.rights))
+	}
+
+	if len(this.source) > 0 {
+		fmt.Fprintf(buf, "		<dc:source>%s</dc:source>\n", html.EscapeString(this.source))
+	}
+
+	if len(this.series) == 0 {
+		// no series
+	} else if version == EPUB_VERSION_200 {
+		fmt.Fprintf(buf, "		<meta name=\"calibre:series\" content=\"%s\"/>\n", html.EscapeString(this.series))
+		if len(this.series_index) > 0 {
+			fmt.Fprintf(buf, "		<meta name=\"calibre:series_index\" content=\"%s\"/>\n", html.EscapeString(this.series_index))
+		}
+	} else {
+		fmt.Fprintf(buf, "		<meta property=\"belongs-to-collection\" id=\"series\">%s</meta>\n", html.EscapeString(this.series))
+		buf.WriteString("		<meta refines=\"#series\" property=\"collection-type\">series</meta>\n")
+		if len(this.series_index) > 0 {
+			fmt.Fprintf(buf, "		<meta refines=\"#series\" property=\"group-position\">%s</meta>\n", html.EscapeString(this.series_index))
+		}
 	}
 
 	if len(this.Publisher()) > 0 {
@@ -324,12 +642,15 @@ func (this *Epub) generateContentOpf(version int) []byte {
 		if (f.Attr & epub_INTERNAL_FILE) != 0 {
 			continue
 		}
-		fmt.Fprintf(buf,
-			"		<item href=\"%s\" id=\"item%04d\" media-type=\"%s\"/>\n",
-			f.Path,
-			i,
-			getMediaType(f.Path),
-		)
+		id := fmt.Sprintf("item%04d", i)
+		if f.Path == this.cover {
+			id = id_of_cover_image
+		}
+		buf.WriteString("		<item href=\"" + f.Path + "\" id=\"" + id + "\"")
+		if props := f.properties(f.Path == this.cover); version != EPUB_VERSION_200 && len(props) > 0 {
+			buf.WriteString(" properties=\"" + props + "\"")
+		}
+		buf.WriteString(" media-type=\"" + f.mediaType() + "\"/>\n")
 	}
 
 	if version == EPUB_VERSION_200 {
@@ -351,7 +672,11 @@ func (this *Epub) generateContentOpf(version int) []byte {
 		if (f.Attr & epub_CONTENT_FILE) == 0 {
 			continue
 		}
-		fmt.Fprintf(buf, "		<itemref idref=\"item%04d\" linear=\"yes\"", i)
+		linear := "yes"
+		if (f.Attr & epub_NON_LINEAR_PAGE) != 0 {
+			linear = "no"
+		}
+		fmt.Fprintf(buf, "		<itemref idref=\"item%04d\" linear=\"%s\"", i, linear)
 		if this.duokan && (f.Attr&epub_FULL_SCREEN_PAGE) != 0 {
 			buf.WriteString(" properties=\"duokan-page-fullscreen\"/>\n")
 		} else {
@@ -359,7 +684,23 @@ func (this *Epub) generateContentOpf(version int) []byte {
 		}
 	}
 
-	buf.WriteString("	</spine>\n</package>")
+	buf.WriteString("	</spine>\n")
+
+	if version == EPUB_VERSION_200 {
+		buf.WriteString("	<guide>\n")
+		if len(this.cover) > 0 {
+			buf.WriteString("		<reference type=\"cover\" title=\"Cover\" href=\"" + path_of_cover_page + "\"/>\n")
+		}
+		if f := this.tocPage(); f != nil {
+			buf.WriteString("		<reference type=\"toc\" title=\"Table of Contents\" href=\"" + f.Path + "\"/>\n")
+		}
+		if f := this.firstContentFile(); f != nil {
+			buf.WriteString("		<reference type=\"text\" title=\"Start\" href=\"" + f.Path + "\"/>\n")
+		}
+		buf.WriteString("	</guide>\n")
+	}
+
+	buf.WriteString("</package>")
 
 	return buf.Bytes()
 }
@@ -382,28 +723,25 @@ func (this *Epub) generateTocNcx() []byte {
 		"	<docTitle><text>%s</text></docTitle>\n"+
 		"	<docAuthor><text>%s</text></docAuthor>\n"+
 		"	<navMap>\n",
-		this.Id(),
+		html.EscapeString(this.Id()),
 		this.Depth(),
-		this.Name(),
-		this.Author(),
+		html.EscapeString(this.Name()),
+		html.EscapeString(this.Author()),
 	)
 
-	depth, playorder := 0, 0
+	// levels of the open nav points, a chapter may be more than one level
+	// deeper than its parent
+	levels, playorder := make([]int, 0, lowest_level), 0
 	for _, f := range this.files {
 		if (f.Attr & epub_CONTENT_FILE) == 0 {
 			continue
 		}
 		for _, c := range f.Chapters {
-			if c.Level == depth {
+			for len(levels) > 0 && levels[len(levels)-1] >= c.Level {
 				buf.WriteString("</navPoint>\n")
-			} else if c.Level > depth {
-				depth = c.Level
-			} else {
-				for c.Level <= depth {
-					buf.WriteString("</navPoint>\n")
-					depth--
-				}
+				levels = levels[:len(levels)-1]
 			}
+			levels = append(levels, c.Level)
 			fmt.Fprintf(buf, ""+
 				"<navPoint id=\"navPoint-%d\" playOrder=\"%d\">\n"+
 				"	<navLabel>\n"+
@@ -412,15 +750,14 @@ func (this *Epub) generateTocNcx() []byte {
 				"	<content src=\"%s\"/>\n",
 				playorder,
 				playorder,
-				c.Title,
-				f.Path+c.Link,
+				html.EscapeString(c.Title),
+				html.EscapeString(f.Path+c.Link),
 			)
 			playorder++
 		}
 	}
-	for depth > 0 {
+	for range levels {
 		buf.WriteString("</navPoint>\n")
-		depth--
 	}
 
 	buf.WriteString("	</navMap>\n</ncx>")
@@ -441,107 +778,230 @@ func (this *Epub) generateNavXhtml() []byte {
 			"	</head>\n"+
 			"	<body>\n"+
 			"		<nav id=\"toc\" epub:type=\"toc\">\n",
-		this.Name(),
+		html.EscapeString(this.Name()),
 	)
 
-	depth, playorder := 0, 0
+	levels, playorder := make([]int, 0, lowest_level), 0
 	for _, f := range this.files {
 		if (f.Attr & epub_CONTENT_FILE) == 0 {
 			continue
 		}
 		for _, c := range f.Chapters {
-			if c.Level == depth {
+			for len(levels) > 0 && levels[len(levels)-1] > c.Level {
+				buf.WriteString("</li>\n</ol>\n")
+				levels = levels[:len(levels)-1]
+			}
+			if len(levels) > 0 && levels[len(levels)-1] == c.Level {
 				buf.WriteString("</li>\n<li")
-			} else if c.Level > depth {
-				buf.WriteString("<ol>\n<li")
-				depth = c.Level
 			} else {
-				for c.Level < depth {
-					buf.WriteString("</li>\n</ol>\n")
-					depth--
-				}
-				buf.WriteString("</li>\n<li")
+				buf.WriteString("<ol>\n<li")
+				levels = append(levels, c.Level)
 			}
 			fmt.Fprintf(buf,
 				" id=\"chapter_%d\">\n	<a href=\"%s\">%s</a>\n",
 				playorder,
-				f.Path+c.Link,
-				c.Title,
+				html.EscapeString(f.Path+c.Link),
+				html.EscapeString(c.Title),
 			)
 			playorder++
 		}
 	}
 
-	for depth > 0 {
+	for range levels {
 		buf.WriteString("</li>\n</ol>\n")
-		depth--
 	}
 
-	buf.WriteString("		</nav>\n	</body>\n</html>")
+	buf.WriteString("		</nav>\n")
+
+	buf.WriteString("		<nav id=\"landmarks\" epub:type=\"landmarks\" hidden=\"hidden\">\n<ol>\n")
+	if len(this.cover) > 0 {
+		buf.WriteString("<li><a epub:type=\"cover\" href=\"" + path_of_cover_page + "\">Cover</a></li>\n")
+	}
+	buf.WriteString("<li><a epub:type=\"toc\" href=\"" + path_of_nav_xhtml + "#toc\">Table of Contents</a></li>\n")
+	if f := this.firstContentFile(); f != nil {
+		buf.WriteString("<li><a epub:type=\"bodymatter\" href=\"" + f.Path + "\">Start</a></li>\n")
+	}
+	buf.WriteString("</ol>\n		</nav>\n	</body>\n</html>")
 
 	return buf.Bytes()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func (this *Epub) Build(version int) ([]byte, error) {
+// generateTocPage generates the TOC page which is a part of the content, so
+// it can be read like other pages on devices which don't support the TOC of
+// the package documents.
+func (this *Epub) generateTocPage() []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf,
+		"<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
+			"<html xmlns=\"http://www.w3.org/1999/xhtml\">\n"+
+			"	<head>\n"+
+			"		<title>%s</title>\n"+
+			"		<style type=\"text/css\">\n"+
+			"			div.makeepub-toc ol { list-style-type: none; margin: 0; padding: 0; }\n"+
+			"			div.makeepub-toc ol ol { padding-left: 1.5em; }\n"+
+			"			div.makeepub-toc li { margin: 0.3em 0; }\n"+
+			"			div.makeepub-toc a { text-decoration: none; }\n"+
+			"		</style>\n",
+		html.EscapeString(this.toc_title),
+	)
+	for _, css := range this.toc_styles {
+		if css = strings.TrimSpace(css); len(css) > 0 {
+			buf.WriteString("		<link href=\"" + html.EscapeString(css) + "\" rel=\"stylesheet\" type=\"text/css\"/>\n")
+		}
+	}
+	fmt.Fprintf(buf,
+		"	</head>\n"+
+			"	<body>\n"+
+			"		<div class=\"makeepub-toc\">\n"+
+			"		<h1>%s</h1>\n",
+		html.EscapeString(this.toc_title),
+	)
+
+	levels := make([]int, 0, lowest_level)
+	for _, f := range this.files {
+		if (f.Attr & epub_CONTENT_FILE) == 0 {
+			continue
+		}
+		for _, c := range f.Chapters {
+			if c.Level > this.toc_depth {
+				continue
+			}
+			for len(levels) > 0 && levels[len(levels)-1] > c.Level {
+				buf.WriteString("</li>\n</ol>\n")
+				levels = levels[:len(levels)-1]
+			}
+			if len(levels) > 0 && levels[len(levels)-1] == c.Level {
+				buf.WriteString("</li>\n<li>")
+			} else {
+				buf.WriteString("<ol>\n<li>")
+				levels = append(levels, c.Level)
+			}
+			fmt.Fprintf(buf,
+				"<a href=\"%s\">%s</a>\n",
+				html.EscapeString(f.Path+c.Link),
+				html.EscapeString(c.Title),
+			)
+		}
+	}
+
+	for range levels {
+		buf.WriteString("</li>\n</ol>\n")
+	}
+
+	buf.WriteString("		</div>\n	</body>\n</html>")
+
+	return buf.Bytes()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// BuildTo writes the book to 'w', data of files added from folders is copied
+// directly, so the whole book is never held in memory.
+func (this *Epub) BuildTo(w io.Writer, version int) error {
+	modified := time.Now()
+	if this.reproducible {
+		modified = this.epoch
+	}
 	compressor := epubCompressor{}
-	if e := compressor.init(); e != nil {
-		return nil, e
+	if e := compressor.init(w, modified); e != nil {
+		return e
+	}
+
+	// internal files are skipped if a file with the same path is generated or
+	// in the manifest, like 'toc.xhtml' in the folder of a book which has a
+	// generated TOC page
+	generated := make(map[string]bool)
+	for _, f := range this.files {
+		if (f.Attr & epub_INTERNAL_FILE) == 0 {
+			generated[f.Path] = true
+		}
 	}
 
 	if version != EPUB_VERSION_NONE {
+		generated[path_of_container_xml] = true
+		generated[path_of_content_opf] = true
+		if version == EPUB_VERSION_200 {
+			generated[path_of_toc_ncx] = true
+		} else {
+			generated[path_of_nav_xhtml] = true
+		}
+		if len(this.cover) > 0 {
+			generated[path_of_cover_page] = true
+		}
+
 		data := this.generateContainerXml()
 		if e := compressor.addFile(path_of_container_xml, data); e != nil {
-			return nil, e
+			return e
 		}
 		data = this.generateContentOpf(version)
 		if e := compressor.addFile(path_of_content_opf, data); e != nil {
-			return nil, e
+			return e
 		}
 		if version == EPUB_VERSION_200 {
 			data = this.generateTocNcx()
 			if e := compressor.addFile(path_of_toc_ncx, data); e != nil {
-				return nil, e
+				return e
 			}
 		} else {
 			data = this.generateNavXhtml()
 			if e := compressor.addFile(path_of_nav_xhtml, data); e != nil {
-				return nil, e
+				return e
 			}
 		}
 		if len(this.cover) > 0 {
 			data = generateImagePage(this.cover, "cover")
 			if e := compressor.addFile(path_of_cover_page, data); e != nil {
-				return nil, e
+				return e
 			}
 		}
 	}
 
+	if f := this.tocPage(); f != nil {
+		f.Data = this.generateTocPage()
+	}
+	if e := this.renderTemplatePages(version, modified); e != nil {
+		return e
+	}
+
 	for _, f := range this.files {
-		if e := compressor.addFile(f.Path, f.Data); e != nil {
-			return nil, e
+		if (f.Attr&epub_INTERNAL_FILE) != 0 && generated[f.Path] {
+			continue
+		}
+		rc, e := f.Open()
+		if e != nil {
+			return e
+		}
+		e = compressor.copyFile(f.Path, rc)
+		rc.Close()
+		if e != nil {
+			return e
 		}
 	}
 
-	if e := compressor.close(); e != nil {
+	return compressor.close()
+}
+
+func (this *Epub) Build(version int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if e := this.BuildTo(buf, version); e != nil {
 		return nil, e
 	}
-
-	return compressor.result(), nil
+	return buf.Bytes(), nil
 }
 
 func (this *Epub) Save(path string, version int) error {
-	data, e := this.Build(version)
+	f, e := os.Create(path)
 	if e != nil {
 		return e
 	}
 
-	f, e := os.Create(path)
-	if e == nil {
-		_, e = f.Write(data)
+	if e = this.BuildTo(f, version); e != nil {
 		f.Close()
+		os.Remove(path)
+		return e
 	}
 
-	return e
+	return f.Close()
 }
@@ -2,11 +2,72 @@ package main
 
 import (
 	"archive/zip"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
+const (
+	// limits against zip bombs
+	max_extract_size  = 4 << 30 // total uncompressed size of all entries
+	max_extract_ratio = 200     // max compression ratio of a large entry
+	min_checked_size  = 1 << 20 // entries smaller than this are not checked
+)
+
+// extractPath returns the path to extract entry 'name' to, an error is
+// returned if the entry would be written outside of folder 'root'.
+func extractPath(root, name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if len(name) == 0 || path.IsAbs(name) || len(filepath.VolumeName(name)) > 0 {
+		return "", errors.New("absolute or empty path")
+	}
+	name = path.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.New("path is outside of the output folder")
+	}
+	return filepath.Join(root, filepath.FromSlash(name)), nil
+}
+
+func extractFile(zf *zip.File, target string) error {
+	size := zf.UncompressedSize64
+	if size >= min_checked_size && size/max_extract_ratio > zf.CompressedSize64 {
+		return fmt.Errorf("compression ratio is too high")
+	}
+
+	if e := os.MkdirAll(filepath.Dir(target), 0755); e != nil {
+		return e
+	}
+
+	rc, e := zf.Open()
+	if e != nil {
+		return e
+	}
+	defer rc.Close()
+
+	f, e := os.Create(target)
+	if e != nil {
+		return e
+	}
+	// the reader fails if the data is longer than the size in the header
+	if _, e = io.Copy(f, rc); e != nil {
+		f.Close()
+		os.Remove(target)
+		return e
+	}
+	if e = f.Close(); e != nil {
+		return e
+	}
+
+	if t := zf.Modified; !t.IsZero() {
+		os.Chtimes(target, t, t)
+	}
+	return nil
+}
+
 func RunExtract() {
 	inpath, outpath := getArg(0, ""), getArg(1, "")
 	if len(inpath) == 0 || len(outpath) == 0 {
@@ -18,38 +79,42 @@ func RunExtract() {
 	}
 	defer zrc.Close()
 
-	if e = os.MkdirAll(outpath, os.ModeDir|0666); e != nil {
+	total := uint64(0)
+	for _, zf := range zrc.File {
+		total += zf.UncompressedSize64
+	}
+	if total > max_extract_size {
+		logger.Fatalf("'%s' is too large after extraction: %d bytes.\n", inpath, total)
+	}
+
+	if e = os.MkdirAll(outpath, 0755); e != nil {
 		logger.Fatalln("failed to create output folder.")
 	}
 
+	failed := 0
 	for _, zf := range zrc.File {
-		path := filepath.Join(outpath, zf.Name)
-
-		// skip folders, if it is not empty, will be created during file creation
-		if zf.FileInfo().IsDir() {
-			continue
-		}
-
-		// create the folder if needed, but no need to check error
-		dir, _ := filepath.Split(path)
-		os.MkdirAll(dir, os.ModeDir|0666)
-
-		rc, e := zf.Open()
+		target, e := extractPath(outpath, zf.Name)
 		if e != nil {
-			logger.Printf("failed to open '%s'.\n", zf.Name)
+			logger.Printf("refused to extract '%s': %s.\n", zf.Name, e.Error())
+			failed++
 			continue
 		}
 
-		if f, e := os.Create(path); e != nil {
-			logger.Printf("failed to create output file '%s'.", zf.Name)
-		} else if _, e = io.Copy(f, rc); e != nil {
-			logger.Printf("error writing data to '%s'.\n", zf.Name)
+		if zf.FileInfo().IsDir() {
+			e = os.MkdirAll(target, 0755)
 		} else {
-			f.Close()
+			e = extractFile(zf, target)
+		}
+		if e != nil {
+			logger.Printf("failed to extract '%s': %s.\n", zf.Name, e.Error())
+			failed++
 		}
+	}
 
-		rc.Close()
+	if failed > 0 {
+		logger.Fatalf("%d of %d entries failed to extract.\n", failed, len(zrc.File))
 	}
+	logger.Printf("%d entries extracted.\n", len(zrc.File))
 }
 
 func init() {
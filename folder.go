@@ -4,7 +4,6 @@ import (
 	"archive/zip"
 	"bytes"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,6 +18,7 @@ type VirtualFolder interface {
 	Walk(fnWalk FxWalk) error
 	ReadDirNames() ([]string, error)
 	Name() string
+	Close() error
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -39,6 +39,10 @@ func (this *SystemFolder) Name() string {
 	return this.path
 }
 
+func (this *SystemFolder) Close() error {
+	return nil
+}
+
 func (this *SystemFolder) Walk(fnWalk FxWalk) error {
 	walk := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -67,6 +71,7 @@ func (this *SystemFolder) ReadDirNames() ([]string, error) {
 
 type ZipFolder struct {
 	zr   *zip.Reader
+	zrc  *zip.ReadCloser // not nil if opened from a file
 	name string
 }
 
@@ -80,13 +85,10 @@ func NewZipFolder(data []byte) (*ZipFolder, error) {
 }
 
 func OpenZipFolder(path string) (*ZipFolder, error) {
-	if data, e := ioutil.ReadFile(path); e != nil {
-		return nil, e
-	} else if zf, e := NewZipFolder(data); e != nil {
+	if zrc, e := zip.OpenReader(path); e != nil {
 		return nil, e
 	} else {
-		zf.name = path
-		return zf, nil
+		return &ZipFolder{zr: &zrc.Reader, zrc: zrc, name: path}, nil
 	}
 }
 
@@ -94,7 +96,21 @@ func (this *ZipFolder) Name() string {
 	return this.name
 }
 
+func (this *ZipFolder) Close() error {
+	if this.zrc != nil {
+		return this.zrc.Close()
+	}
+	return nil
+}
+
 func (this *ZipFolder) OpenFile(path string) (io.ReadCloser, error) {
+	for _, f := range this.zr.File {
+		if f.Name == path {
+			return f.Open()
+		}
+	}
+	// not found, try again, ignore case
+	path = strings.ToLower(path)
 	for _, f := range this.zr.File {
 		if strings.ToLower(f.Name) == path {
 			return f.Open()
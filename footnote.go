@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	notes_footnote = "footnote" // notes are moved to the end of chapters
+	notes_endnote  = "endnote"  // notes are moved to a dedicated file
+
+	makeepub_noteref    = "makeepub-noteref"
+	makeepub_noteref_id = "makeepub-noteref-%d"
+	makeepub_notes_id   = "makeepub-notes"
+	duokan_footnote     = "duokan-footnote"
+)
+
+// isNoteRef checks if link 'a' refers to a note, that is, its class contains
+// 'makeepub-noteref', or it is in a '<sup>', or it only contains a '<sup>'.
+// Footnote references of markdown are in the form of the later.
+func isNoteRef(a *html.Node) bool {
+	if a.DataAtom != atom.A {
+		return false
+	}
+	href := getAttributeValue(a, "href", "")
+	if len(href) < 2 || href[0] != '#' {
+		return false
+	}
+	if hasClass(a, makeepub_noteref) {
+		return true
+	}
+	if a.Parent != nil && a.Parent.DataAtom == atom.Sup {
+		return true
+	}
+	var child *html.Node
+	for n := a.FirstChild; n != nil; n = n.NextSibling {
+		if isBlankNode(n) {
+			continue
+		}
+		if child != nil {
+			return false
+		}
+		child = n
+	}
+	return child != nil && child.DataAtom == atom.Sup
+}
+
+// removeEmptyAncestors removes 'node' and its ancestors if they have nothing
+// but white spaces and '<hr>', the container of markdown footnotes is removed
+// in this way.
+func removeEmptyAncestors(node *html.Node) {
+	for node != nil && node.Type == html.ElementNode && node.DataAtom != atom.Body {
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			if !isBlankNode(n) && n.DataAtom != atom.Hr {
+				return
+			}
+		}
+		parent := node.Parent
+		if parent == nil {
+			return
+		}
+		parent.RemoveChild(node)
+		node = parent
+	}
+}
+
+// makeNote moves 'note' into an '<aside>' which is a note referred by link
+// 'ref', and adds back link to the reference.
+func (this *EpubMaker) makeNote(ref, note *html.Node, id string) *html.Node {
+	// the reference needs an id for the back link
+	refId := noteRefId(ref)
+	if len(refId) == 0 {
+		refId = fmt.Sprintf(makeepub_noteref_id, this.note_id)
+		this.note_id++
+		ref.Attr = append(ref.Attr, html.Attribute{Key: "id", Val: refId})
+	}
+	removeAttribute(ref, "epub:type")
+	ref.Attr = append(ref.Attr, html.Attribute{Key: "epub:type", Val: "noteref"})
+	if this.book.Duokan() {
+		addClass(ref, duokan_footnote)
+	}
+
+	parent := note.Parent
+	parent.RemoveChild(note)
+	removeEmptyAncestors(parent)
+	removeAttribute(note, "id")
+
+	// remove back links of markdown footnotes and other links to the
+	// reference, a new one is added later
+	backlinks := make([]*html.Node, 0, 1)
+	forEachElement(note, func(n *html.Node) {
+		if n.DataAtom != atom.A {
+			return
+		}
+		if hasClass(n, "footnote-backref") || getAttributeValue(n, "role", "") == "doc-backlink" {
+			backlinks = append(backlinks, n)
+		} else if href := getAttributeValue(n, "href", ""); len(href) > 1 && href[0] == '#' && noteId(n) == refId {
+			backlinks = append(backlinks, n)
+		}
+	})
+	for _, n := range backlinks {
+		// the '<sup>' which only contains the back link is removed too
+		if p := n.Parent; p.DataAtom == atom.Sup && strings.TrimSpace(nodeText(p)) == strings.TrimSpace(nodeText(n)) {
+			n = p
+		}
+		if prev := n.PrevSibling; prev != nil && prev.Type == html.TextNode {
+			prev.Data = strings.TrimRight(prev.Data, " \u00a0")
+		} else if next := n.NextSibling; prev == nil && next != nil && next.Type == html.TextNode {
+			next.Data = strings.TrimLeft(next.Data, " \u00a0")
+		}
+		n.Parent.RemoveChild(n)
+	}
+
+	epubType := notes_footnote
+	if this.notes == notes_endnote {
+		epubType = notes_endnote
+	}
+	aside := newElement(atom.Aside, html.Attribute{Key: "epub:type", Val: epubType})
+	container := aside
+	if this.book.Duokan() {
+		ol := newElement(atom.Ol, html.Attribute{Key: "class", Val: "duokan-footnote-content"})
+		container = newElement(atom.Li,
+			html.Attribute{Key: "class", Val: "duokan-footnote-item"},
+			html.Attribute{Key: "id", Val: id},
+		)
+		ol.AppendChild(container)
+		aside.AppendChild(ol)
+	} else {
+		aside.Attr = append(aside.Attr, html.Attribute{Key: "id", Val: id})
+	}
+
+	// keep paragraphs, but not the containers of the note
+	switch note.DataAtom {
+	case atom.Li, atom.Div, atom.Aside, atom.Section:
+		for n := note.FirstChild; n != nil; n = note.FirstChild {
+			note.RemoveChild(n)
+			container.AppendChild(n)
+		}
+	default:
+		container.AppendChild(note)
+	}
+
+	label := strings.TrimSpace(nodeText(ref))
+	if len(label) == 0 {
+		label = "^"
+	}
+	link := newElement(atom.A, html.Attribute{Key: "href", Val: "#" + refId})
+	link.AppendChild(&html.Node{Type: html.TextNode, Data: label})
+
+	first := container.FirstChild
+	for first != nil && isBlankNode(first) {
+		first = first.NextSibling
+	}
+	if first != nil && first.DataAtom == atom.P {
+		container = first
+	}
+	sp := &html.Node{Type: html.TextNode, Data: " "}
+	container.InsertBefore(sp, container.FirstChild)
+	container.InsertBefore(link, sp)
+
+	return aside
+}
+
+// noteRefId returns the id of note reference 'ref', markdown footnotes have
+// it on the parent '<sup>'
+func noteRefId(ref *html.Node) string {
+	id := getAttributeValue(ref, "id", "")
+	if p := ref.Parent; len(id) == 0 && p != nil && p.DataAtom == atom.Sup {
+		id = getAttributeValue(p, "id", "")
+	}
+	return id
+}
+
+// noteId returns the id of the note which link 'a' refers to
+func noteId(a *html.Node) string {
+	id := getAttributeValue(a, "href", "")[1:]
+	if s, e := url.PathUnescape(id); e == nil {
+		id = s
+	}
+	return id
+}
+
+// processNotes moves notes referred by note references to the end of the
+// chapters which refer them, or to a dedicated file at the end of the book.
+func (this *EpubMaker) processNotes() {
+	if len(this.notes) == 0 || len(this.pending) == 0 {
+		return
+	}
+
+	targets := make(map[string]*html.Node)
+	for _, pc := range this.pending {
+		forEachElement(pc.body, func(node *html.Node) {
+			id := getAttributeValue(node, "id", "")
+			if _, ok := targets[id]; len(id) > 0 && !ok {
+				targets[id] = node
+			}
+		})
+	}
+
+	// collect all the references before moving anything, the notes and the
+	// ids of the references are also collected to find the back links
+	type noteRef struct {
+		pc  *pendingChapter
+		ref *html.Node
+	}
+	refs := make([]noteRef, 0, 64)
+	notes, refIds := make(map[*html.Node]bool), make(map[string]bool)
+	for i := range this.pending {
+		pc := &this.pending[i]
+		forEachElement(pc.body, func(node *html.Node) {
+			if !isNoteRef(node) {
+				return
+			}
+			refs = append(refs, noteRef{pc: pc, ref: node})
+			if note, ok := targets[noteId(node)]; ok {
+				notes[note] = true
+			}
+			if id := noteRefId(node); len(id) > 0 {
+				refIds[id] = true
+			}
+		})
+	}
+
+	// links in notes and links to references are back links, not references
+	inNote := func(node *html.Node) bool {
+		for n := node.Parent; n != nil; n = n.Parent {
+			if notes[n] {
+				return true
+			}
+		}
+		return false
+	}
+
+	endnotes := make([]*html.Node, 0, 64)
+	moved := make(map[string]bool)
+	for _, r := range refs {
+		id := noteId(r.ref)
+		if refIds[id] || inNote(r.ref) {
+			continue
+		}
+		if moved[id] {
+			// a note referred more than once, keep the link as is
+			continue
+		}
+		note, ok := targets[id]
+		if !ok {
+			this.writeLog("note '#" + id + "' does not exist.")
+			continue
+		}
+		moved[id] = true
+		aside := this.makeNote(r.ref, note, id)
+		if this.notes == notes_footnote {
+			r.pc.body.AppendChild(aside)
+		} else {
+			endnotes = append(endnotes, aside)
+		}
+	}
+	if len(endnotes) == 0 {
+		return
+	}
+
+	body := newElement(atom.Body)
+	h := newElement(atom.H1, html.Attribute{Key: "id", Val: makeepub_notes_id})
+	h.AppendChild(&html.Node{Type: html.TextNode, Data: this.notes_title})
+	body.AppendChild(h)
+	for _, aside := range endnotes {
+		body.AppendChild(aside)
+	}
+
+	// the dedicated file shares the document of the last chapter
+	root := this.pending[len(this.pending)-1].root
+	chapters := []Chapter{{Level: 1, Title: this.notes_title, Link: "#" + makeepub_notes_id}}
+	f := this.book.AddChapter(chapters, nil)
+	this.pending = append(this.pending, pendingChapter{file: f, root: root, body: body})
+}
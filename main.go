@@ -11,16 +11,21 @@ import (
 const version = "1.1.0"
 
 func showUsage() {
-	usage := `Create/Batch Create/Pack/Extract EPUB file(s). Merge HTML/Text files.
+	usage := `Create/Batch Create/Pack/Extract/Validate/Decompile EPUB file(s), modify metadata
+of an EPUB file or convert it between EPUB2 and EPUB3. Merge HTML/Text files.
 It can also work as a web server to convert an uploaded zip file to an EPUB.
 Please refer to manual for detailed usage.
 
 COMMAND LINE
-  Create       : makeepub <VirtualFolder> [OutputFolder] [-epub2] [-noduokan]
-  Batch Create : makeepub -b <InputFolder> [OutputFolder] [-epub2] [-noduokan]
-                 makeepub -b <BatchFile> [OutputFolder] [-epub2] [-noduokan]
+  Create       : makeepub <VirtualFolder> [OutputFolder] [-epub2] [-noduokan] [-reproducible]
+  Batch Create : makeepub -b <InputFolder> [OutputFolder] [-epub2] [-noduokan] [-reproducible]
+                 makeepub -b <BatchFile> [OutputFolder] [-epub2] [-noduokan] [-reproducible]
   Pack         : makeepub -p <VirtualFolder> <OutputFile>
   Extract      : makeepub -e <EpubFile> <OutputFolder>
+  Validate     : makeepub -v <EpubFile>
+  Decompile    : makeepub -d <EpubFile> <OutputFolder>
+  Metadata     : makeepub -m <EpubFile> <key=value|IniFile>...
+  Convert      : makeepub -convert <epub2|epub3> <EpubFile> [OutputFile]
   Merge HTML   : makeepub -mh <VirtualFolder> <OutputFile>
   Merge Text   : makeepub -mt <VirtualFolder> <OutputFile>
   Web Server   : makeepub -s [Port]
@@ -30,11 +35,16 @@ ARGUMENT
   OutputFolder : An OS folder to store the output file(s).
   -epub2       : Generate books using EPUB2 format, otherwise EPUB3.
   -noduokan    : Disable DuoKan externsion.
+  -reproducible: Generate the same output for the same input, timestamps are
+                 fixed to environment variable SOURCE_DATE_EPOCH.
   InputFolder  : An OS folder which contains the input folder(s)/file(s).
   BatchFile    : A text which lists the path of 'VirtualFolders' to be
                  processed, one line for one 'VirtualFolder'
   OutputFile   : The path of the output file.
   EpubFile     : The path of an EPUB file.
+  key=value    : Metadata to modify, key is one of name, title, author, language,
+                 id, description, publisher and cover (path of an image file).
+  IniFile      : An ini file whose [book] section is applied to the EPUB file.
   Port         : The TCP port to listen to, default value is 80.
 `
 	fmt.Print(usage)
@@ -3,13 +3,20 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/andybalholm/cascadia"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
@@ -22,40 +29,179 @@ const (
 	makeepub_chapter_id  = "makeepub-chapter-%d"
 	makeepub_chapter     = "makeepub-chapter"
 	makeepub_not_chapter = "makeepub-not-chapter"
+	makeepub_toc         = "makeepub-toc"
 	data_chapter_level   = "data-chapter-level"
 	data_chapter_title   = "data-chapter-title"
+	data_chapter_css     = "data-chapter-css"
+
+	// 1980-01-01, the earliest time which can be stored in a zip file
+	default_source_date_epoch = 315532800
 )
 
+var (
+	// names of the file which contains the content of the book, in order of
+	// priority
+	book_sources = []string{"book.html", "book.md", "book.txt"}
+
+	// comments in style sheets
+	css_comment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+)
+
+// a chapter which has been split out but not rendered yet, rendering is
+// delayed until all chapters are known, so that links can be resolved.
+type pendingChapter struct {
+	file   *File
+	source string     // the content file the chapter is split from
+	root   *html.Node // root of the document the chapter belongs to
+	body   *html.Node // 'body' element of the chapter
+}
+
+// a rule to find split points of a level with a CSS selector
+type splitRule struct {
+	level    int
+	selector cascadia.Selector
+	title    string // attribute for the title, the text is used if empty
+}
+
 type EpubMaker struct {
-	folder      VirtualFolder
-	book        *Epub
-	logger      *log.Logger
-	output_path string
-	chapter_id  int
-	toc         int
-	split       int
-	by_header   int
-	body        *html.Node // 'body' element of the original html
-	skip        bool       // skip next header (<h1>,<h2>...)?
-	blank       bool       // current chapter is blank?
+	folder       VirtualFolder
+	book         *Epub
+	logger       *log.Logger
+	output_path  string
+	content      []string   // patterns of the files which contain the content
+	sources      []string   // names of the files which contain the content
+	source       string     // name of the content file being split
+	templates    []string   // names of the template files of generated pages
+	encoding     string     // encoding of the content, empty for auto detection
+	stylesheets  []string   // style sheets for markdown/text content
+	text_rules   []textRule // rules to detect chapter titles in text content
+	max_title    int        // max length of chapter titles in text content
+	chapter_id   int
+	note_id      int
+	toc          int
+	split        int
+	by_header    int
+	max_size     int                       // max size of the body of a chapter, 0 for no limit
+	nested       bool                      // split points can be nested in other elements
+	body         *html.Node                // 'body' element of the original html
+	parent       *html.Node                // parent of the nodes being split
+	wrappers     []*html.Node              // ancestors of 'parent' inside 'body'
+	chapter      *html.Node                // 'body' element of current chapter
+	container    *html.Node                // where to add nodes to current chapter
+	chapters     []Chapter                 // TOC entries of current chapter
+	last_level   int                       // level of last split point, if no text after it
+	size         int                       // size of the body of current chapter
+	rules        []splitRule               // rules to find split points
+	para_rules   []textRule                // rules to find split points in paragraphs
+	promote      bool                      // convert paragraphs matched by 'para_rules' to headers
+	rule_nodes   map[*html.Node]*splitRule // nodes matched by the rules
+	strip_ruby   bool                      // remove ruby annotations from chapter titles
+	clean_head   bool                      // remove scripts and unused styles from chapters
+	notes        string                    // how to process notes, empty for not processing
+	notes_title  string                    // title of the dedicated file for end notes
+	skip         bool                      // skip next header (<h1>,<h2>...)?
+	blank        bool                      // current chapter is blank?
+	pending      []pendingChapter
+	reproducible bool // build reproducibly even if not required by book.ini
+
+	title_page     *template.Template
+	copyright_page *template.Template
+	colophon       *template.Template
 }
 
 func NewEpubMaker(logger *log.Logger) *EpubMaker {
 	return &EpubMaker{logger: logger}
 }
 
-func (this *EpubMaker) parseBook() (*html.Node, error) {
-	f, e := this.folder.OpenFile("book.html")
+func (this *EpubMaker) SetReproducible(reproducible bool) {
+	this.reproducible = reproducible
+}
+
+// findSources returns the files which contain the content of the book in
+// reading order. They are listed in the [content] section of book.ini, and
+// files matched by a pattern are sorted in natural order. If the section
+// does not exist, it is the first existing file in 'book_sources'.
+func (this *EpubMaker) findSources() ([]string, error) {
+	if len(this.content) == 0 {
+		for _, name := range book_sources {
+			rc, e := this.folder.OpenFile(name)
+			if os.IsNotExist(e) {
+				continue
+			} else if e != nil {
+				return nil, e
+			}
+			rc.Close()
+			return []string{name}, nil
+		}
+		return nil, fmt.Errorf("none of '%s' exists.", strings.Join(book_sources, "', '"))
+	}
+
+	all := make([]string, 0, 256)
+	e := this.folder.Walk(func(p string) error {
+		all = append(all, filepath.ToSlash(p))
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	sources, found := make([]string, 0, 16), make(map[string]bool)
+	for _, pattern := range this.content {
+		matched := make([]string, 0, 16)
+		for _, p := range all {
+			if ok, _ := path.Match(pattern, p); ok && !found[p] {
+				matched = append(matched, p)
+				found[p] = true
+			}
+		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("'%s' does not match any file.", pattern)
+		}
+		sort.Slice(matched, func(i, j int) bool {
+			return naturalLess(matched[i], matched[j])
+		})
+		sources = append(sources, matched...)
+	}
+	return sources, nil
+}
+
+// readBook reads the content of the book from file 'name', and converts it
+// to html if required.
+func (this *EpubMaker) readBook(name string) ([]byte, error) {
+	rc, e := this.folder.OpenFile(name)
+	if e != nil {
+		return nil, e
+	}
+	data, e := ioutil.ReadAll(rc)
+	rc.Close()
+	if e == nil {
+		data, e = decodeText(data, this.encoding)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	if ext := strings.ToLower(path.Ext(name)); ext == ".md" {
+		return markdownToHtml(data, this.book.Name(), this.stylesheets)
+	} else if ext == ".txt" {
+		return textToHtml(data, this.book.Name(), this.stylesheets, this.text_rules, this.max_title)
+	}
+	return data, nil
+}
+
+func (this *EpubMaker) parseBook(name string) (*html.Node, error) {
+	data, e := this.readBook(name)
 	if e != nil {
 		return nil, e
 	}
-	defer f.Close()
-	root, e := html.Parse(f)
+	root, e := html.Parse(bytes.NewReader(data))
 	if e != nil {
 		return root, e
 	}
 
-	e = fmt.Errorf("structure of 'book.html' is invalid.")
+	fixMetaCharset(root)
+
+	e = fmt.Errorf("structure of '%s' is invalid.", name)
 	if root.Type != html.DocumentNode {
 		return root, e
 	}
@@ -105,31 +251,31 @@ func (this *EpubMaker) parseBook() (*html.Node, error) {
 func (this *EpubMaker) addFilesToBook() error {
 	walk := func(path string) error {
 		p := strings.ToLower(path)
-		if p == "book.ini" || p == "book.html" {
+		if p == "book.ini" {
 			return nil
 		}
-
-		rc, e := this.folder.OpenFile(path)
-		if e != nil {
-			return e
+		for _, name := range this.sources {
+			if p == strings.ToLower(name) {
+				return nil
+			}
 		}
-		defer rc.Close()
-		data, e := ioutil.ReadAll(rc)
-		if e != nil {
-			return e
+		for _, name := range this.templates {
+			if p == strings.ToLower(name) {
+				return nil
+			}
 		}
 
 		if p == "cover.png" || p == "cover.jpg" || p == "cover.gif" {
-			this.book.SetCoverImage(p)
+			this.book.SetCoverImage(path)
 		}
-		this.book.AddFile(path, data)
+		this.book.AddFolderFile(this.folder, path)
 		return nil
 	}
 
 	return this.folder.Walk(walk)
 }
 
-func checkHeaderNode(node *html.Node) *Chapter {
+func (this *EpubMaker) checkHeaderNode(node *html.Node) *Chapter {
 	if len(node.Data) != 2 || node.Data[0] != 'h' {
 		return nil
 	}
@@ -142,8 +288,8 @@ func checkHeaderNode(node *html.Node) *Chapter {
 	title := ""
 	if attr := findAttribute(node, data_chapter_title); attr != nil {
 		title = attr.Val
-	} else if node.FirstChild != nil {
-		title = node.FirstChild.Data
+	} else {
+		title = headingText(node, !this.strip_ruby)
 	}
 	return &Chapter{Level: level, Title: title}
 }
@@ -165,19 +311,27 @@ func (this *EpubMaker) checkChapterNode(node *html.Node) *Chapter {
 	}
 
 	// if this is a 'header' element, use its own 'level' & 'title'
-	if c := checkHeaderNode(node); c != nil {
+	if c := this.checkHeaderNode(node); c != nil {
 		return c
 	}
 
-	// try to find next 'header' element for level & title
-	for n := this.body.FirstChild; n != nil; n = n.NextSibling {
+	// try to find next split point for level & title, in the same order as
+	// 'checkNewChapter', and skip it when it is reached
+	for n := this.parent.FirstChild; n != nil; n = n.NextSibling {
 		if n.Type != html.ElementNode {
 			continue
 		}
 		if hasClass(n, makeepub_chapter) {
 			return nil
 		}
-		if c := checkHeaderNode(n); c != nil {
+		c := this.checkRegexNode(n)
+		if c == nil {
+			c = this.checkRuleNode(n)
+		}
+		if c == nil {
+			c = this.checkHeaderNode(n)
+		}
+		if c != nil {
 			this.skip = true
 			return c
 		}
@@ -186,14 +340,65 @@ func (this *EpubMaker) checkChapterNode(node *html.Node) *Chapter {
 	return nil
 }
 
+// regexLevel returns the level of paragraph 'node' if its text matches a
+// rule in 'para_rules', or 0 if not match.
+func (this *EpubMaker) regexLevel(node *html.Node) int {
+	if len(this.para_rules) == 0 || node.DataAtom != atom.P {
+		return 0
+	}
+	return matchTextRule(headingText(node, !this.strip_ruby), this.para_rules, this.max_title)
+}
+
+// checkRegexNode checks if paragraph 'node' is a split point by its text, the
+// paragraph is converted to a header if required.
+func (this *EpubMaker) checkRegexNode(node *html.Node) *Chapter {
+	level := this.regexLevel(node)
+	if level == 0 {
+		return nil
+	}
+	if this.promote {
+		node.Data = fmt.Sprintf("h%d", level)
+		node.DataAtom = atom.Lookup([]byte(node.Data))
+	}
+	return &Chapter{Level: level, Title: headingText(node, !this.strip_ruby)}
+}
+
+// checkRuleNode checks if 'node' is matched by a split rule
+func (this *EpubMaker) checkRuleNode(node *html.Node) *Chapter {
+	rule, ok := this.rule_nodes[node]
+	if !ok {
+		return nil
+	}
+	title := ""
+	if len(rule.title) > 0 {
+		title = getAttributeValue(node, rule.title, "")
+	}
+	if len(title) == 0 {
+		title = headingText(node, !this.strip_ruby)
+	}
+	return &Chapter{Level: rule.level, Title: title}
+}
+
 func (this *EpubMaker) checkNewChapter(node *html.Node) *Chapter {
 	if node.Type != html.ElementNode {
 		return nil
 	}
 
-	var c *Chapter = nil
-	if c = this.checkChapterNode(node); c == nil {
-		if c = checkHeaderNode(node); c == nil {
+	c := this.checkRegexNode(node)
+	if c == nil {
+		c = this.checkChapterNode(node)
+	} else if this.skip {
+		this.skip = false
+		return nil
+	}
+	if c == nil {
+		if c = this.checkRuleNode(node); c != nil && this.skip {
+			this.skip = false
+			return nil
+		}
+	}
+	if c == nil {
+		if c = this.checkHeaderNode(node); c == nil {
 			return nil
 		}
 		if this.skip {
@@ -247,61 +452,190 @@ func (this *EpubMaker) checkFullScreenImage(node *html.Node) (string, string) {
 	return "", ""
 }
 
+// isSplitPoint checks if 'node' is a split point, a full screen image or the
+// marker of the TOC page, it does not change anything.
+func (this *EpubMaker) isSplitPoint(node *html.Node) bool {
+	if node.Type != html.ElementNode {
+		return false
+	}
+	if hasClass(node, makeepub_toc) {
+		return true
+	}
+	if _, ok := this.rule_nodes[node]; ok || hasClass(node, makeepub_chapter) || this.regexLevel(node) > 0 {
+		return true
+	}
+	if c := this.checkHeaderNode(node); c != nil && c.Level >= this.by_header && !hasClass(node, makeepub_not_chapter) {
+		return true
+	}
+	path, _ := this.checkFullScreenImage(node)
+	return len(path) > 0
+}
+
+// hasNestedSplitPoint checks if there are split points inside 'node'
+func (this *EpubMaker) hasNestedSplitPoint(node *html.Node) bool {
+	if node.Type != html.ElementNode || this.isSplitPoint(node) {
+		return false
+	}
+	found := false
+	forEachElement(node, func(n *html.Node) {
+		found = found || this.isSplitPoint(n)
+	})
+	return found
+}
+
+// isLargeContainer checks if 'node' is a container of paragraphs which is
+// too large for a single chapter
+func (this *EpubMaker) isLargeContainer(node *html.Node) bool {
+	if this.max_size <= 0 || node.Type != html.ElementNode {
+		return false
+	}
+	switch node.DataAtom {
+	case atom.Div, atom.Section, atom.Article, atom.Main:
+		return xhtmlSize(node) > this.max_size
+	}
+	return false
+}
+
+// startChapter saves current chapter and starts a new one, the wrappers of
+// the nodes being split are re-created in the new chapter.
+func (this *EpubMaker) startChapter(root *html.Node) {
+	// remove wrappers which have nothing in them from current chapter
+	isEmpty := func(node *html.Node) bool {
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			if !isBlankNode(n) {
+				return false
+			}
+		}
+		return true
+	}
+	for n := this.container; n != this.chapter && isEmpty(n); {
+		p := n.Parent
+		p.RemoveChild(n)
+		n = p
+	}
+
+	this.saveChapter(root, this.chapter, this.chapters)
+	this.chapter = resetBody(this.chapter)
+	this.chapters = nil
+	this.size = 0
+	this.container = this.chapter
+	for _, w := range this.wrappers {
+		n := cloneNode(w)
+		this.container.AppendChild(n)
+		this.container = n
+	}
+}
+
 func (this *EpubMaker) splitChapter(root *html.Node) {
 	this.body = findFirstDirectChild(root, atom.Html)
 	this.body = findFirstDirectChild(this.body, atom.Body)
 	this.blank = true
 
-	body := resetBody(this.body)
-	chapters := make([]Chapter, 0)
-	lastLevel := unknown_level
+	// selectors are matched before the split, because nodes are moved out
+	// of their parents during the split
+	this.rule_nodes = make(map[*html.Node]*splitRule)
+	for i := range this.rules {
+		for _, node := range this.rules[i].selector.MatchAll(this.body) {
+			if _, ok := this.rule_nodes[node]; !ok {
+				this.rule_nodes[node] = &this.rules[i]
+			}
+		}
+	}
+
+	this.chapter = resetBody(this.body)
+	this.container = this.chapter
+	this.chapters = nil
+	this.wrappers = nil
+	this.last_level = unknown_level
+	this.size = 0
 
-	for node := this.body.FirstChild; node != nil; node = this.body.FirstChild {
-		this.body.RemoveChild(node)
+	this.splitNodes(root, this.body)
+	this.saveChapter(root, this.chapter, this.chapters)
+}
+
+// splitNodes moves the child nodes of 'parent' into chapters, and starts new
+// chapters at split points.
+func (this *EpubMaker) splitNodes(root, parent *html.Node) {
+	for node := parent.FirstChild; node != nil; node = parent.FirstChild {
+		parent.RemoveChild(node)
+		this.parent = parent
 
 		if isBlankNode(node) {
-			body.AppendChild(node)
+			this.container.AppendChild(node)
+			continue
+		}
+
+		// the marker of the position of the TOC page, it must be checked before
+		// nested split points, because the nodes after it are its children
+		if node.Type == html.ElementNode && hasClass(node, makeepub_toc) {
+			if this.book.tocPage() != nil {
+				this.writeLog("TOC page is already added, marker ignored.")
+			} else if this.book.toc_depth > 0 {
+				this.startChapter(root)
+				this.last_level = unknown_level
+				this.book.AddTocPage(nil)
+			}
+			// '<div class="makeepub-toc"/>' is not self-closing in html, the
+			// nodes after it are its children, move them back
+			for n := node.LastChild; n != nil; n = node.LastChild {
+				node.RemoveChild(n)
+				parent.InsertBefore(n, parent.FirstChild)
+			}
+			continue
+		}
+
+		// split inside the node, and keep it as a wrapper of the content
+		if this.nested && (this.hasNestedSplitPoint(node) || this.isLargeContainer(node)) {
+			n := cloneNode(node)
+			this.container.AppendChild(n)
+			this.container = n
+			this.wrappers = append(this.wrappers, node)
+			this.splitNodes(root, node)
+			this.wrappers = this.wrappers[:len(this.wrappers)-1]
+			this.container = this.container.Parent
 			continue
 		}
 
 		c := this.checkNewChapter(node)
 
 		if path, alt := this.checkFullScreenImage(node); len(path) > 0 {
-			this.saveChapter(root, chapters)
-			body = resetBody(body)
-			chapters = nil
-			lastLevel = unknown_level
+			this.startChapter(root)
+			this.last_level = unknown_level
 			this.saveFullScreenImage(path, alt, c)
 			continue
 		}
 
 		if c == nil {
-			lastLevel = unknown_level
-			body.AppendChild(node)
+			// the chapter is too large, continue it in a new file, the TOC
+			// entries are kept in the current one
+			size := xhtmlSize(node)
+			if this.max_size > 0 && !this.blank && this.size+size > this.max_size {
+				this.startChapter(root)
+			}
+			this.size += size
+			this.last_level = unknown_level
+			this.container.AppendChild(node)
 			this.blank = false
 			continue
 		}
 
-		// c.Level > lastLevel means current chapter is a child of last
+		// c.Level > last_level means current chapter is a child of last
 		// chapter, and there's no text (only chapter names), so merge it into
 		// last chapter
-		if c.Level <= this.split && c.Level <= lastLevel {
-			this.saveChapter(root, chapters)
-			body = resetBody(body)
-			chapters = nil
-			lastLevel = c.Level
+		if c.Level <= this.split && c.Level <= this.last_level {
+			this.startChapter(root)
+			this.last_level = c.Level
 		}
 
 		// level 0 is only for chapter split, will not be added to chapter list
 		if c.Level > 0 && c.Level <= this.toc && len(c.Title) > 0 {
-			chapters = append(chapters, *c)
+			this.chapters = append(this.chapters, *c)
 		}
 
-		body.AppendChild(node)
+		this.size += xhtmlSize(node)
+		this.container.AppendChild(node)
 		this.blank = false
 	}
-
-	this.saveChapter(root, chapters)
 }
 
 func resetBody(body *html.Node) *html.Node {
@@ -320,19 +654,293 @@ func (this *EpubMaker) saveFullScreenImage(path, alt string, c *Chapter) {
 	this.book.AddFullScreenImage(path, alt, chapters)
 }
 
-func (this *EpubMaker) saveChapter(root *html.Node, chapters []Chapter) {
+func (this *EpubMaker) saveChapter(root, body *html.Node, chapters []Chapter) {
 	if !this.blank {
-		buf := new(bytes.Buffer)
-		html.Render(buf, root)
-		this.book.AddChapter(chapters, buf.Bytes())
+		f := this.book.AddChapter(chapters, nil)
+		this.pending = append(this.pending, pendingChapter{file: f, source: this.source, root: root, body: body})
 		this.blank = true
 	}
 }
 
+// resolveLinks rewrites links whose target was moved into another chapter
+// file by the split: fragment-only links (href="#foo") and links to the
+// content files (href="part2.html#foo" or href="part2.html") are changed to
+// the chapter files which hold the targets, like 'chapter_XXXX.xhtml#foo'.
+func (this *EpubMaker) resolveLinks() {
+	targets := make(map[string]string) // id => path of chapter file
+	sources := make(map[string]string) // id => content file of the id
+	local := make(map[string]string)   // 'source#id' => path of chapter file
+	firsts := make(map[string]string)  // content file => path of its first chapter file
+	for _, pc := range this.pending {
+		path, source := pc.file.Path, pc.source
+		if _, ok := firsts[source]; !ok && len(source) > 0 {
+			firsts[source] = path
+		}
+		forEachElement(pc.body, func(node *html.Node) {
+			id := getAttributeValue(node, "id", "")
+			if len(id) == 0 {
+				return
+			}
+			if _, ok := local[source+"#"+id]; !ok {
+				local[source+"#"+id] = path
+			}
+			if s, ok := sources[id]; !ok {
+				targets[id], sources[id] = path, source
+			} else if s != source {
+				this.writeLog("id '" + id + "' is duplicated in '" + s + "' and '" + source + "'.")
+				sources[id] = source // only report once for each pair of files
+			}
+		})
+	}
+
+	for _, pc := range this.pending {
+		path := pc.file.Path
+		forEachElement(pc.body, func(node *html.Node) {
+			if node.DataAtom != atom.A && node.DataAtom != atom.Area {
+				return
+			}
+			href := findAttribute(node, "href")
+			if href == nil || len(href.Val) == 0 {
+				return
+			}
+
+			source, fragment := pc.source, ""
+			if i := strings.IndexByte(href.Val, '#'); i >= 0 {
+				fragment = href.Val[i+1:]
+			}
+			if href.Val[0] != '#' {
+				// a link to another file, only those to content files are
+				// changed, and a link without fragment goes to the first
+				// chapter of the content file. Like other files, paths of
+				// content files are relative to the root folder.
+				source, _ = resolveHref("", href.Val)
+				first, ok := firsts[source]
+				if len(source) == 0 || !ok {
+					return
+				}
+				if len(fragment) == 0 {
+					href.Val = first
+					return
+				}
+			} else if len(fragment) == 0 {
+				return
+			}
+
+			id := fragment
+			if s, e := url.PathUnescape(id); e == nil {
+				id = s
+			}
+			target, ok := local[source+"#"+id]
+			if !ok && href.Val[0] == '#' {
+				target, ok = targets[id]
+			}
+			if !ok {
+				this.writeLog("link target '" + href.Val + "' does not exist.")
+			} else if target != path {
+				href.Val = target + "#" + fragment
+			} else {
+				href.Val = "#" + fragment
+			}
+		})
+	}
+}
+
+// styleUsed checks if any rule in style sheet 'css' applies to an element of
+// 'doc', at-rules and selectors which cannot be checked are regarded as used.
+func styleUsed(css string, doc *html.Node) bool {
+	css = css_comment.ReplaceAllString(css, "")
+	for {
+		i := strings.IndexByte(css, '{')
+		if i < 0 {
+			return false
+		}
+		selectors := strings.TrimSpace(css[:i])
+		if strings.HasPrefix(selectors, "@") {
+			return true
+		}
+		for _, s := range strings.Split(selectors, ",") {
+			sel, e := cascadia.Compile(s)
+			if e != nil || sel.MatchFirst(doc) != nil {
+				return true
+			}
+		}
+		j := strings.IndexByte(css[i:], '}')
+		if j < 0 {
+			return false
+		}
+		css = css[i+j+1:]
+	}
+}
+
+// chapterHead creates the 'head' of a chapter from 'head' of the original
+// document: the title is set to 'title', style sheets specified by the
+// 'data-chapter-css' attributes in the chapter are linked, and scripts and
+// unused styles are removed if required.
+func (this *EpubMaker) chapterHead(head, doc *html.Node, title string) *html.Node {
+	head = cloneTree(head)
+
+	t := findFirstDirectChild(head, atom.Title)
+	if t == nil {
+		t = newElement(atom.Title)
+		head.AppendChild(t)
+	}
+	if len(title) == 0 {
+		title = strings.TrimSpace(nodeText(t))
+	}
+	if len(title) == 0 {
+		title = this.book.Name()
+	}
+	for t.FirstChild != nil {
+		t.RemoveChild(t.FirstChild)
+	}
+	t.AppendChild(&html.Node{Type: html.TextNode, Data: title})
+
+	forEachElement(doc, func(node *html.Node) {
+		attr := findAttribute(node, data_chapter_css)
+		if attr == nil {
+			return
+		}
+		for _, href := range strings.FieldsFunc(attr.Val, func(r rune) bool { return r == ',' || r == ' ' }) {
+			exists := false
+			for _, link := range findDirectChildren(head, atom.Link) {
+				exists = exists || getAttributeValue(link, "href", "") == href
+			}
+			if !exists {
+				head.AppendChild(newElement(atom.Link,
+					html.Attribute{Key: "rel", Val: "stylesheet"},
+					html.Attribute{Key: "type", Val: "text/css"},
+					html.Attribute{Key: "href", Val: href},
+				))
+			}
+		}
+		removeAttribute(node, data_chapter_css)
+	})
+
+	if this.clean_head {
+		for node := head.FirstChild; node != nil; {
+			next := node.NextSibling
+			if node.DataAtom == atom.Script || (node.DataAtom == atom.Style && !styleUsed(nodeText(node), doc)) {
+				head.RemoveChild(node)
+			}
+			node = next
+		}
+	}
+
+	return head
+}
+
+func (this *EpubMaker) renderChapters() error {
+	// chapters without TOC entry use the title of the previous one
+	title := ""
+	for _, pc := range this.pending {
+		Html := findFirstDirectChild(pc.root, atom.Html)
+		if body := findFirstDirectChild(Html, atom.Body); body != pc.body {
+			Html.InsertBefore(pc.body, body)
+			Html.RemoveChild(body)
+		}
+		if len(pc.file.Chapters) > 0 {
+			title = pc.file.Chapters[0].Title
+		}
+		head := findFirstDirectChild(Html, atom.Head)
+		ch := this.chapterHead(head, Html, title)
+		Html.InsertBefore(ch, head)
+		Html.RemoveChild(head)
+
+		buf := new(bytes.Buffer)
+		e := renderXhtml(buf, pc.root)
+		Html.InsertBefore(head, ch)
+		Html.RemoveChild(ch)
+		if e != nil {
+			return e
+		}
+		pc.file.Data = buf.Bytes()
+	}
+	this.pending = nil
+	return nil
+}
+
 func (this *EpubMaker) writeLog(msg string) {
 	this.logger.Printf("%s: %s\n", this.folder.Name(), msg)
 }
 
+// parseCreator parses a creator/contributor in format 'Name | Role | FileAs',
+// 'Role' and 'FileAs' are optional.
+func parseCreator(s, role string) Creator {
+	fields := strings.Split(s, "|")
+	c := Creator{Name: strings.TrimSpace(fields[0]), Role: role}
+	if len(fields) > 1 {
+		if r := strings.TrimSpace(fields[1]); len(r) > 0 {
+			c.Role = strings.ToLower(r)
+		}
+	}
+	if len(fields) > 2 {
+		c.FileAs = strings.TrimSpace(fields[2])
+	}
+	return c
+}
+
+// isMarcRelator checks if 'role' looks like a MARC relator code
+func isMarcRelator(role string) bool {
+	if len(role) != 3 {
+		return false
+	}
+	for _, c := range role {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCreators loads options 'key1', 'key2'... until an option is missing
+func (this *EpubMaker) loadCreators(cfg *Config, key, role string, add func(Creator)) {
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s%d", key, i)
+		s := cfg.GetString("/book/"+name, "")
+		if len(s) == 0 {
+			break
+		}
+		c := parseCreator(s, role)
+		if !isMarcRelator(c.Role) {
+			this.writeLog("role '" + c.Role + "' of option '" + name + "' is not a MARC relator code.")
+		}
+		add(c)
+	}
+}
+
+// loadPageTemplate loads the template of a generated page specified by option
+// 'name', which is the path of the template file or 'default' for the
+// built-in template 'dflt'. It returns nil if the page is not required.
+func (this *EpubMaker) loadPageTemplate(cfg *Config, name, dflt string) *template.Template {
+	s := strings.TrimSpace(cfg.GetString("/pages/"+name, ""))
+	if len(s) == 0 {
+		return nil
+	}
+
+	var data []byte
+	if s != default_template {
+		rc, e := this.folder.OpenFile(s)
+		if e == nil {
+			data, e = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+		if e != nil {
+			this.writeLog(e.Error())
+			this.writeLog("failed to read template of '" + name + "', page ignored.")
+			return nil
+		}
+		this.templates = append(this.templates, s)
+	}
+
+	tmpl, e := parsePageTemplate(name, data, dflt)
+	if e != nil {
+		this.writeLog(e.Error())
+		this.writeLog("template of '" + name + "' is invalid, page ignored.")
+		return nil
+	}
+	return tmpl
+}
+
 func (this *EpubMaker) loadConfig() error {
 	rc, e := this.folder.OpenFile("book.ini")
 	if e != nil {
@@ -360,7 +968,94 @@ func (this *EpubMaker) loadConfig() error {
 		this.writeLog("option 'ByHeader' is invalid, will use default value 1.")
 		this.by_header = 1
 	}
+	this.nested = cfg.GetBool("/split/Nested", false)
+	this.strip_ruby = cfg.GetBool("/split/StripRuby", true)
+	this.clean_head = cfg.GetBool("/split/CleanHead", false)
+	this.notes = strings.ToLower(cfg.GetString("/split/Notes", ""))
+	if len(this.notes) > 0 && this.notes != notes_footnote && this.notes != notes_endnote {
+		this.writeLog("option 'Notes' is invalid, notes will not be processed.")
+		this.notes = ""
+	}
+	this.notes_title = cfg.GetString("/split/NotesTitle", "Notes")
+	this.max_size = cfg.GetInt("/split/MaxSize", 0) * 1024
+	if this.max_size < 0 {
+		this.writeLog("option 'MaxSize' is invalid, will use default value 0.")
+		this.max_size = 0
+	}
+	this.rules = nil
+	for i := 0; i <= lowest_level; i++ {
+		name := fmt.Sprintf("Level%d", i)
+		if s := cfg.GetString("/split/"+name, ""); len(s) == 0 {
+			continue
+		} else if sel, e := cascadia.Compile(s); e != nil {
+			this.writeLog("option '" + name + "' is invalid, ignored.")
+		} else {
+			title := cfg.GetString("/split/"+name+"Title", "")
+			this.rules = append(this.rules, splitRule{level: i, selector: sel, title: title})
+		}
+	}
+	this.para_rules = nil
+	for i := 1; i <= lowest_level; i++ {
+		name := fmt.Sprintf("Regex%d", i)
+		if s := cfg.GetString("/split/"+name, ""); len(s) == 0 {
+			continue
+		} else if re, e := regexp.Compile(s); e != nil {
+			this.writeLog("option '" + name + "' is invalid, ignored.")
+		} else {
+			this.para_rules = append(this.para_rules, textRule{level: i, pattern: re})
+		}
+	}
+	this.promote = cfg.GetBool("/split/PromoteHeader", false)
+	this.content = nil
+	for i := 1; ; i++ {
+		s, ok := cfg.Lookup(fmt.Sprintf("/content/File%d", i))
+		if !ok {
+			break
+		}
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			this.content = append(this.content, filepath.ToSlash(s))
+		}
+	}
+	depth := cfg.GetInt("/tocpage/Depth", 0)
+	if depth < 0 || depth > lowest_level {
+		this.writeLog("option 'Depth' of TOC page is invalid, will use default value 0.")
+		depth = 0
+	}
+	this.book.SetTocPage(
+		cfg.GetString("/tocpage/Title", "Contents"),
+		depth,
+		strings.Split(cfg.GetString("/tocpage/StyleSheet", ""), ","),
+	)
+
+	this.templates = nil
+	this.title_page = this.loadPageTemplate(cfg, "TitlePage", default_title_page)
+	this.copyright_page = this.loadPageTemplate(cfg, "CopyrightPage", default_copyright_page)
+	this.colophon = this.loadPageTemplate(cfg, "Colophon", default_colophon)
+
 	this.output_path = cfg.GetString("/output/path", "")
+	this.encoding = cfg.GetString("/book/encoding", "")
+	this.stylesheets = strings.Split(cfg.GetString("/book/StyleSheet", ""), ",")
+
+	this.text_rules = nil
+	for i := 1; i <= lowest_level; i++ {
+		name := fmt.Sprintf("Level%d", i)
+		if s := cfg.GetString("/text/"+name, ""); len(s) == 0 {
+			continue
+		} else if re, e := regexp.Compile(s); e != nil {
+			this.writeLog("option '" + name + "' is invalid, ignored.")
+		} else {
+			this.text_rules = append(this.text_rules, textRule{level: i, pattern: re})
+		}
+	}
+	if len(this.text_rules) == 0 {
+		re := regexp.MustCompile(default_chapter_pattern)
+		this.text_rules = append(this.text_rules, textRule{level: 1, pattern: re})
+	}
+	this.max_title = cfg.GetInt("/text/MaxTitleLength", 40)
+	if this.max_title <= 0 {
+		this.writeLog("option 'MaxTitleLength' is invalid, will use default value 40.")
+		this.max_title = 40
+	}
 
 	s := cfg.GetString("/book/id", "")
 	this.book.SetId(s)
@@ -372,10 +1067,50 @@ func (this *EpubMaker) loadConfig() error {
 	this.book.SetName(s)
 
 	s = cfg.GetString("/book/author", "")
-	if len(s) == 0 {
+	if len(s) > 0 {
+		fileAs := cfg.GetString("/book/AuthorFileAs", "")
+		this.book.AddCreator(Creator{Name: s, Role: "aut", FileAs: fileAs})
+	}
+	this.loadCreators(cfg, "creator", "aut", this.book.AddCreator)
+	this.loadCreators(cfg, "contributor", "ctb", this.book.AddContributor)
+	if len(this.book.Author()) == 0 {
 		this.writeLog("author name is empty.")
 	}
-	this.book.SetAuthor(s)
+
+	subjects := cfg.GetString("/book/subjects", "")
+	for _, subject := range strings.FieldsFunc(subjects, func(r rune) bool { return r == ',' || r == '，' }) {
+		if subject = strings.TrimSpace(subject); len(subject) > 0 {
+			this.book.AddSubject(subject)
+		}
+	}
+
+	this.book.SetRights(cfg.GetString("/book/rights", ""))
+	this.book.SetSource(cfg.GetString("/book/source", ""))
+
+	if s = cfg.GetString("/book/date", ""); len(s) > 0 {
+		if date, e := formatDate(s); e != nil {
+			this.writeLog("option 'date' is invalid, ignored.")
+		} else {
+			this.book.SetDate(date)
+		}
+	}
+
+	if s = cfg.GetString("/book/modified", ""); len(s) > 0 {
+		if t, e := parseDate(s); e != nil {
+			this.writeLog("option 'modified' is invalid, ignored.")
+		} else {
+			this.book.SetModified(t)
+		}
+	}
+
+	if s = cfg.GetString("/book/series", ""); len(s) > 0 {
+		index := cfg.GetString("/book/SeriesIndex", "")
+		if _, e := strconv.ParseFloat(index, 64); len(index) > 0 && e != nil {
+			this.writeLog("option 'SeriesIndex' is invalid, ignored.")
+			index = ""
+		}
+		this.book.SetSeries(s, index)
+	}
 
 	s = cfg.GetString("/book/publisher", "")
 	this.book.SetPublisher(s)
@@ -386,9 +1121,37 @@ func (this *EpubMaker) loadConfig() error {
 	s = cfg.GetString("/book/language", "zh-CN")
 	this.book.SetLanguage(s)
 
+	if epoch, ok := this.sourceDateEpoch(cfg); ok {
+		this.book.SetReproducible(epoch)
+	}
+
 	return nil
 }
 
+// sourceDateEpoch returns the fixed time for reproducible builds, which is
+// from option 'SourceDateEpoch', or environment variable 'SOURCE_DATE_EPOCH'
+// if reproducible build is enabled by command line. 'ok' is false if the
+// build is not required to be reproducible.
+func (this *EpubMaker) sourceDateEpoch(cfg *Config) (epoch time.Time, ok bool) {
+	s := cfg.GetString("/output/SourceDateEpoch", "")
+	if len(s) == 0 {
+		if !this.reproducible {
+			return time.Time{}, false
+		}
+		s = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+
+	sec := int64(default_source_date_epoch)
+	if len(s) > 0 {
+		if n, e := strconv.ParseInt(s, 10, 64); e != nil || n < 0 {
+			this.writeLog("source date epoch '" + s + "' is invalid, will use default value.")
+		} else {
+			sec = n
+		}
+	}
+	return time.Unix(sec, 0).UTC(), true
+}
+
 func (this *EpubMaker) Process(folder VirtualFolder, duokan bool) error {
 	this.folder = folder
 	this.book = NewEpub(duokan)
@@ -399,12 +1162,46 @@ func (this *EpubMaker) Process(folder VirtualFolder, duokan bool) error {
 		return e
 	}
 
-	if root, e := this.parseBook(); e != nil {
+	sources, e := this.findSources()
+	if e != nil {
 		this.writeLog(e.Error())
-		this.writeLog("failed to parse 'book.html'.")
+		this.writeLog("failed to find the content of the book.")
 		return e
-	} else {
-		this.splitChapter(root)
+	}
+	this.sources = sources
+
+	// all files share the chapter list and the ids of chapters
+	for _, name := range sources {
+		if root, e := this.parseBook(name); e != nil {
+			this.writeLog(e.Error())
+			this.writeLog("failed to parse the content of the book.")
+			return e
+		} else {
+			this.source = name
+			this.splitChapter(root)
+		}
+	}
+
+	this.processNotes()
+	this.resolveLinks()
+	if e := this.renderChapters(); e != nil {
+		this.writeLog(e.Error())
+		this.writeLog("failed to render chapters.")
+		return e
+	}
+
+	// the title page, the copyright page and the TOC page follow the cover,
+	// the colophon is the last page
+	first := this.book.firstContentFile()
+	if this.title_page != nil {
+		this.book.AddTemplatePage(path_of_title_page, this.title_page, first)
+	}
+	if this.copyright_page != nil {
+		this.book.AddTemplatePage(path_of_copyright_page, this.copyright_page, first)
+	}
+	this.book.AddTocPage(first)
+	if this.colophon != nil {
+		this.book.AddTemplatePage(path_of_colophon, this.colophon, nil)
 	}
 
 	if e := this.addFilesToBook(); e != nil {
@@ -457,14 +1254,23 @@ func RunMake() {
 	}
 
 	maker := NewEpubMaker(logger)
+	maker.SetReproducible(getFlagBool("reproducible"))
 
-	if inpath := getArg(0, ""); len(inpath) == 0 {
+	inpath := getArg(0, "")
+	if len(inpath) == 0 {
 		onCommandLineError()
-	} else if folder, e := OpenVirtualFolder(inpath); e != nil {
+	}
+	folder, e := OpenVirtualFolder(inpath)
+	if e != nil {
 		logger.Fatalf("%s: failed to open source folder/file.\n", inpath)
-	} else if maker.Process(folder, duokan) != nil {
-		os.Exit(1)
-	} else if maker.SaveTo(getArg(1, ""), ver) != nil {
+	}
+
+	// files are read from the folder when saving, so close it at last
+	if e = maker.Process(folder, duokan); e == nil {
+		e = maker.SaveTo(getArg(1, ""), ver)
+	}
+	folder.Close()
+	if e != nil {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	mdhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// writeHtmlHead writes the beginning of an html document generated from other
+// formats, up to the start tag of 'body'.
+func writeHtmlHead(buf *bytes.Buffer, title string, css []string) {
+	buf.WriteString("<!DOCTYPE html>\n<html>\n<head>\n\t<meta charset=\"utf-8\"/>\n")
+	buf.WriteString("\t<title>" + html.EscapeString(title) + "</title>\n")
+	for _, s := range css {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			buf.WriteString("\t<link href=\"" + html.EscapeString(s) + "\" type=\"text/css\" rel=\"stylesheet\"/>\n")
+		}
+	}
+	buf.WriteString("</head>\n<body>\n")
+}
+
+// markdownToHtml converts CommonMark text into a complete html document, with
+// tables, footnotes and heading attributes ('# Title {.makeepub-chapter}')
+// enabled. Raw html in the text is kept as is.
+func markdownToHtml(src []byte, title string, css []string) ([]byte, error) {
+	md := goldmark.New(
+		goldmark.WithExtensions(extension.Table, extension.Strikethrough, extension.Footnote),
+		goldmark.WithParserOptions(parser.WithAttribute()),
+		goldmark.WithRendererOptions(mdhtml.WithUnsafe()),
+	)
+
+	buf := new(bytes.Buffer)
+	writeHtmlHead(buf, title, css)
+
+	if e := md.Convert(removeUtf8Bom(src), buf); e != nil {
+		return nil, e
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
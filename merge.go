@@ -9,21 +9,36 @@ import (
 	"golang.org/x/net/html/atom"
 )
 
+// readTextFile reads a file and converts its content to UTF-8
+func readTextFile(folder VirtualFolder, name string) []byte {
+	f, e := folder.OpenFile(name)
+	if e != nil {
+		logger.Fatalf("error reading '%s'.\n", name)
+	}
+	defer f.Close()
+
+	data, e := ioutil.ReadAll(f)
+	if e != nil {
+		logger.Fatalf("error reading '%s'.\n", name)
+	}
+
+	if data, e = decodeText(data, ""); e != nil {
+		logger.Fatalf("error decoding '%s'.\n", name)
+	}
+	return data
+}
+
 func mergeHtml(folder VirtualFolder, names []string) []byte {
 	var result *html.Node = nil
 	var body *html.Node = nil
 
 	for _, name := range names {
-		f, e := folder.OpenFile(name)
-		if e != nil {
-			logger.Fatalf("error reading '%s'.\n", name)
-		}
-
-		doc, e := html.Parse(f)
-		f.Close()
+		data := readTextFile(folder, name)
+		doc, e := html.Parse(bytes.NewReader(data))
 		if e != nil {
 			logger.Fatalf("error parsing '%s'.\n", name)
 		}
+		fixMetaCharset(doc)
 
 		b := findFirstChild(doc, atom.Body)
 		if b == nil {
@@ -54,20 +69,8 @@ func mergeText(folder VirtualFolder, names []string) []byte {
 	buf := new(bytes.Buffer)
 
 	for _, name := range names {
-		f, e := folder.OpenFile(name)
-		if e != nil {
-			logger.Fatalf("error reading '%s'.\n", name)
-		}
-
-		data, e := ioutil.ReadAll(f)
-		if e != nil {
-			logger.Fatalf("error reading '%s'.\n", name)
-		}
-
-		buf.Write(removeUtf8Bom(data))
+		buf.Write(readTextFile(folder, name))
 		buf.WriteByte('\n')
-
-		f.Close()
 	}
 
 	return buf.Bytes()
@@ -86,10 +89,12 @@ func RunMerge() {
 
 	names, e := folder.ReadDirNames()
 	if e != nil {
+		folder.Close()
 		logger.Fatal("failed to get input file list.")
 	}
 
 	if len(names) == 0 {
+		folder.Close()
 		logger.Println("input folder is empty.")
 		return
 	}
@@ -102,9 +107,10 @@ func RunMerge() {
 	} else {
 		data = mergeText(folder, names)
 	}
+	folder.Close()
 
 	if e = ioutil.WriteFile(outpath, data, 0666); e != nil {
-		logger.Fatalln("failed to write to output file.\n")
+		logger.Fatalln("failed to write to output file.")
 	}
 }
 
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	xmlns_dc  = "http://purl.org/dc/elements/1.1/"
+	xmlns_opf = "http://www.idpf.org/2007/opf"
+)
+
+var (
+	// options which can be modified, and the names of the 'dc' elements
+	metadata_options = map[string]string{
+		"name":        "title",
+		"title":       "title",
+		"author":      "creator",
+		"language":    "language",
+		"id":          "identifier",
+		"description": "description",
+		"publisher":   "publisher",
+		"cover":       "",
+	}
+
+	// options which are other names of an option
+	metadata_aliases = map[string]string{
+		"title": "name",
+	}
+
+	// attributes of html which refer to other files
+	html_ref_attr = regexp.MustCompile(`(\s(?:src|href|xlink:href|poster)\s*=\s*)(["'])([^"']*)(["'])`)
+	ncx_meta      = regexp.MustCompile(`<meta\s[^>]*>`)
+	ncx_uid_name  = regexp.MustCompile(`\sname\s*=\s*("dtb:uid"|'dtb:uid')`)
+	ncx_content   = regexp.MustCompile(`(\scontent\s*=\s*)("[^"]*"|'[^']*')`)
+)
+
+// an element of the OPF, with its offsets in the OPF
+type opfElement struct {
+	name  string
+	space string
+	attr  []xml.Attr
+	text  string
+	start int64 // start of the start tag
+	inner int64 // end of the start tag
+	close int64 // start of the end tag
+	end   int64 // end of the end tag
+}
+
+func (this *opfElement) getAttr(space, name string) string {
+	for _, a := range this.attr {
+		if a.Name.Local == name && (len(space) == 0 || a.Name.Space == space) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// a change of the OPF, bytes in [start, end) are replaced by 'text'
+type opfChange struct {
+	start, end int64
+	text       string
+}
+
+// metadataEditor modifies the OPF as text, so that everything not changed
+// is kept as is.
+type metadataEditor struct {
+	opf         []byte
+	version     string
+	uniqueId    string
+	root        *opfElement   // the 'package' element
+	dc          []*opfElement // 'dc' elements in metadata
+	metas       []*opfElement // 'meta' elements in metadata
+	items       []*opfElement // 'item' elements in manifest
+	metadataEnd int64         // start of '</metadata>'
+	manifestEnd int64         // start of '</manifest>'
+	changes     []opfChange
+}
+
+func (this *metadataEditor) scan() error {
+	d := xml.NewDecoder(bytes.NewReader(this.opf))
+	stack := make([]*opfElement, 0, 8)
+	for {
+		off := d.InputOffset()
+		tok, e := d.Token()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return e
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			el := &opfElement{
+				name:  t.Name.Local,
+				space: t.Name.Space,
+				attr:  t.Attr,
+				start: off,
+				inner: d.InputOffset(),
+			}
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].name
+			}
+			if el.name == "package" {
+				this.root = el
+				this.version = el.getAttr("", "version")
+				this.uniqueId = el.getAttr("", "unique-identifier")
+			} else if parent == "metadata" && el.space == xmlns_dc {
+				this.dc = append(this.dc, el)
+			} else if parent == "metadata" && el.name == "meta" {
+				this.metas = append(this.metas, el)
+			} else if parent == "manifest" && el.name == "item" {
+				this.items = append(this.items, el)
+			}
+			stack = append(stack, el)
+
+		case xml.EndElement:
+			el := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			el.close, el.end = off, d.InputOffset()
+			if el.name == "metadata" {
+				this.metadataEnd = off
+			} else if el.name == "manifest" {
+				this.manifestEnd = off
+			}
+
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+
+	if this.metadataEnd == 0 || this.manifestEnd == 0 {
+		return fmt.Errorf("metadata or manifest is missing")
+	}
+	return nil
+}
+
+// rawName returns the qualified name of an element, like 'dc:title'
+func (this *metadataEditor) rawName(el *opfElement) string {
+	tag := this.opf[el.start+1 : el.inner]
+	if i := bytes.IndexAny(tag, " \t\r\n/>"); i >= 0 {
+		tag = tag[:i]
+	}
+	return string(tag)
+}
+
+// dcPrefix returns the prefix of the 'dc' elements
+func (this *metadataEditor) dcPrefix() string {
+	if len(this.dc) > 0 {
+		if name := this.rawName(this.dc[0]); strings.Contains(name, ":") {
+			return name[:strings.Index(name, ":")+1]
+		}
+		return ""
+	}
+	return "dc:"
+}
+
+func (this *metadataEditor) setText(el *opfElement, text string) {
+	text = html.EscapeString(text)
+	if el.inner < el.close || !bytes.HasSuffix(this.opf[el.start:el.inner], []byte("/>")) {
+		this.changes = append(this.changes, opfChange{start: el.inner, end: el.close, text: text})
+		return
+	}
+	// self-closing tag
+	tag := strings.TrimSuffix(string(this.opf[el.start:el.inner]), "/>")
+	tag = strings.TrimRight(tag, " \t\r\n") + ">"
+	text = tag + text + "</" + this.rawName(el) + ">"
+	this.changes = append(this.changes, opfChange{start: el.start, end: el.end, text: text})
+}
+
+// setAttr sets attributes of the start tag of 'el', 'attrs' are pairs of
+// names and values.
+func (this *metadataEditor) setAttr(el *opfElement, attrs ...string) {
+	tag := string(this.opf[el.start:el.inner])
+	for i := 0; i+1 < len(attrs); i += 2 {
+		name, value := attrs[i], attrs[i]+"=\""+html.EscapeString(attrs[i+1])+"\""
+		re := regexp.MustCompile(`\s` + regexp.QuoteMeta(name) + `\s*=\s*("[^"]*"|'[^']*')`)
+		if loc := re.FindStringIndex(tag); loc != nil {
+			tag = tag[:loc[0]+1] + value + tag[loc[1]:]
+		} else if strings.HasSuffix(tag, "/>") {
+			tag = strings.TrimRight(strings.TrimSuffix(tag, "/>"), " \t\r\n") + " " + value + "/>"
+		} else {
+			tag = strings.TrimRight(strings.TrimSuffix(tag, ">"), " \t\r\n") + " " + value + ">"
+		}
+	}
+	this.changes = append(this.changes, opfChange{start: el.start, end: el.inner, text: tag})
+}
+
+// removeAttr removes an attribute from the start tag of 'el'
+func (this *metadataEditor) removeAttr(el *opfElement, name string) {
+	tag := string(this.opf[el.start:el.inner])
+	re := regexp.MustCompile(`\s+` + regexp.QuoteMeta(name) + `\s*=\s*("[^"]*"|'[^']*')`)
+	if loc := re.FindStringIndex(tag); loc != nil {
+		tag = tag[:loc[0]] + tag[loc[1]:]
+		this.changes = append(this.changes, opfChange{start: el.start, end: el.inner, text: tag})
+	}
+}
+
+// remove removes element 'el' and the white spaces before it
+func (this *metadataEditor) remove(el *opfElement) {
+	start := el.start
+	for start > 0 && strings.IndexByte(" \t\r\n", this.opf[start-1]) >= 0 {
+		start--
+	}
+	this.changes = append(this.changes, opfChange{start: start, end: el.end})
+}
+
+// insert inserts an element before the end tag at 'offset', with the same
+// indent as the siblings.
+func (this *metadataEditor) insert(offset int64, text string) {
+	i := offset
+	for i > 0 && (this.opf[i-1] == ' ' || this.opf[i-1] == '\t') {
+		i--
+	}
+	if i > 0 && this.opf[i-1] == '\n' {
+		indent := string(this.opf[i:offset])
+		text = indent + "\t" + text + "\n"
+		offset = i
+	}
+	this.changes = append(this.changes, opfChange{start: offset, end: offset, text: text})
+}
+
+func (this *metadataEditor) findDc(name string) *opfElement {
+	for _, el := range this.dc {
+		if el.name == name {
+			return el
+		}
+	}
+	return nil
+}
+
+// refinement returns the value of the refinement 'property' of element 'id'
+func (this *metadataEditor) refinement(id, property string) string {
+	if len(id) == 0 {
+		return ""
+	}
+	for _, m := range this.metas {
+		if m.getAttr("", "refines") == "#"+id && m.getAttr("", "property") == property {
+			return strings.TrimSpace(m.text)
+		}
+	}
+	return ""
+}
+
+// findAuthor returns the first creator whose role is 'aut', or the first
+// creator if there's no such creator.
+func (this *metadataEditor) findAuthor() *opfElement {
+	var first *opfElement
+	for _, el := range this.dc {
+		if el.name != "creator" {
+			continue
+		}
+		if first == nil {
+			first = el
+		}
+		role := el.getAttr(xmlns_opf, "role")
+		if len(role) == 0 {
+			role = this.refinement(el.getAttr("", "id"), "role")
+		}
+		if role == "aut" {
+			return el
+		}
+	}
+	return first
+}
+
+func (this *metadataEditor) hasId(id string) bool {
+	for _, el := range append(append(this.dc, this.metas...), this.items...) {
+		if el.getAttr("", "id") == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *metadataEditor) newId(id string) string {
+	base := id
+	for i := 1; this.hasId(id); i++ {
+		id = fmt.Sprintf("%s%d", base, i)
+	}
+	return id
+}
+
+func (this *metadataEditor) setMetadata(key, value string) {
+	name := metadata_options[key]
+	var el *opfElement
+	if name == "creator" {
+		el = this.findAuthor()
+	} else if name == "identifier" {
+		for _, id := range this.dc {
+			if len(this.uniqueId) > 0 && id.name == "identifier" && id.getAttr("", "id") == this.uniqueId {
+				el = id
+			}
+		}
+		if el == nil && len(this.uniqueId) == 0 {
+			// the package has no unique identifier, point it to the new one
+			this.uniqueId = this.newId("bookid")
+			this.setAttr(this.root, "unique-identifier", this.uniqueId)
+		}
+	} else {
+		el = this.findDc(name)
+	}
+
+	if el != nil {
+		this.setText(el, value)
+		if name == "creator" {
+			// the old 'file-as' is not correct anymore
+			this.removeAttr(el, "opf:file-as")
+			for _, m := range this.metas {
+				if m.getAttr("", "refines") == "#"+el.getAttr("", "id") && m.getAttr("", "property") == "file-as" {
+					this.remove(m)
+				}
+			}
+		}
+		return
+	}
+
+	prefix := this.dcPrefix()
+	text := "<" + prefix + name
+	if name == "identifier" {
+		text += " id=\"" + html.EscapeString(this.uniqueId) + "\""
+	} else if name == "creator" && this.version == "2.0" {
+		text += " opf:role=\"aut\""
+	}
+	text += ">" + html.EscapeString(value) + "</" + prefix + name + ">"
+	if name == "creator" && this.version != "2.0" {
+		id := this.newId("creator")
+		text = "<" + prefix + name + " id=\"" + id + "\">" + html.EscapeString(value) + "</" + prefix + name + ">"
+		this.insert(this.metadataEnd, text)
+		text = "<meta refines=\"#" + id + "\" property=\"role\" scheme=\"marc:relators\">aut</meta>"
+	}
+	this.insert(this.metadataEnd, text)
+}
+
+// touch updates the modification time of EPUB3
+func (this *metadataEditor) touch() {
+	for _, m := range this.metas {
+		if m.getAttr("", "property") == "dcterms:modified" {
+			this.setText(m, time.Now().UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// result applies the changes to the OPF, changes at the same offset are
+// applied in the order they are made, and overlapped changes are refused.
+func (this *metadataEditor) result() ([]byte, error) {
+	sort.SliceStable(this.changes, func(i, j int) bool {
+		return this.changes[i].start < this.changes[j].start
+	})
+	buf := make([]byte, 0, len(this.opf)+1024)
+	pos := int64(0)
+	for _, c := range this.changes {
+		if c.start < pos {
+			return nil, fmt.Errorf("conflicted changes at offset %d", c.start)
+		}
+		buf = append(buf, this.opf[pos:c.start]...)
+		buf = append(buf, c.text...)
+		pos = c.end
+	}
+	return append(buf, this.opf[pos:]...), nil
+}
+
+// setNcxUid sets 'dtb:uid' of NCX 'data' to 'uid'
+func setNcxUid(data []byte, uid string) []byte {
+	return ncx_meta.ReplaceAllFunc(data, func(tag []byte) []byte {
+		if !ncx_uid_name.Match(tag) {
+			return tag
+		}
+		return ncx_content.ReplaceAll(tag, []byte("${1}\""+html.EscapeString(uid)+"\""))
+	})
+}
+
+// replaceRefs replaces the references to file 'old' in file 'base' with file
+// 'name' in the same folder, 'data' is the content of 'base'. Only the
+// attributes of html and 'url()' of css which resolve to 'old' are replaced.
+func replaceRefs(data []byte, base, old, name string) []byte {
+	// both regular expressions have the quotes and the value in group 1~3
+	re, prefix, suffix := html_ref_attr, "", ""
+	if getMediaType(base) == "text/css" {
+		re, prefix, suffix = css_url, "url(", ")"
+	}
+	return re.ReplaceAllFunc(data, func(m []byte) []byte {
+		sub := re.FindSubmatch(m)
+		if re == html_ref_attr {
+			prefix, sub = string(sub[1]), sub[1:]
+		}
+		value := string(sub[2])
+		if p, _ := resolveHref(base, html.UnescapeString(value)); p != old {
+			return m
+		}
+		u := strings.SplitN(value, "#", 2)
+		u[0] = u[0][:strings.LastIndex(u[0], "/")+1] + name
+		return []byte(prefix + string(sub[1]) + strings.Join(u, "#") + string(sub[3]) + suffix)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// an EPUB file whose metadata is being modified
+type epubMetadataFile struct {
+	path    string
+	zrc     *zip.ReadCloser
+	pkg     *epubPackage
+	editor  *metadataEditor
+	replace map[string][]byte // files whose data are replaced
+	remove  map[string]bool   // files to be removed
+	added   []string          // paths of new files, data are in 'replace'
+}
+
+// setCover replaces the cover image with image file 'cover'. If the format
+// of the image is changed, the image is renamed, and the references to it
+// are updated.
+func (this *epubMetadataFile) setCover(cover string) error {
+	data, e := ioutil.ReadFile(cover)
+	if e != nil {
+		return e
+	}
+	ext := strings.ToLower(filepath.Ext(cover))
+	mt := getMediaType(ext)
+	if !strings.HasPrefix(mt, "image/") {
+		return fmt.Errorf("'%s' is not an image", cover)
+	}
+
+	old := this.pkg.coverPath()
+	var item *opfElement
+	for _, el := range this.editor.items {
+		p, _ := resolveHref(this.pkg.opfPath, el.getAttr("", "href"))
+		if len(old) > 0 && p == old {
+			item = el
+		}
+	}
+
+	// no cover yet, add one, or use the item which is the same image
+	if item == nil {
+		p := path.Join(path.Dir(this.pkg.opfPath), "cover"+ext)
+		if el := this.itemAt(p); el != nil {
+			if same, e := this.sameData(p, data); e != nil {
+				return e
+			} else if same {
+				this.useAsCover(el)
+				return nil
+			}
+		}
+		p = this.freePath(p)
+		id := this.editor.newId("cover-image")
+		text := "<item id=\"" + id + "\" href=\"" + path.Base(p) + "\" media-type=\"" + mt + "\""
+		if this.editor.version != "2.0" {
+			text += " properties=\"cover-image\""
+		}
+		this.editor.insert(this.editor.manifestEnd, text+"/>")
+		this.editor.insert(this.editor.metadataEnd, "<meta name=\"cover\" content=\""+id+"\"/>")
+		this.replace[p] = data
+		this.added = append(this.added, p)
+		return nil
+	}
+
+	if getMediaType(old) == mt {
+		this.replace[old] = data
+		return nil
+	}
+
+	p := this.freePath(strings.TrimSuffix(old, path.Ext(old)) + ext)
+	href := item.getAttr("", "href")
+	href = href[:strings.LastIndex(href, "/")+1] + path.Base(p)
+	this.editor.setAttr(item, "href", href, "media-type", mt)
+	this.remove[old] = true
+	this.replace[p] = data
+	this.added = append(this.added, p)
+
+	// update references in content files and style sheets
+	for _, zf := range this.zrc.File {
+		mt := getMediaType(zf.Name)
+		if mt != "application/xhtml+xml" && mt != "text/html" && mt != "text/css" {
+			continue
+		}
+		data, e := readFolderFile(this.pkg.folder, zf.Name)
+		if e != nil {
+			return e
+		}
+		if nd := replaceRefs(data, zf.Name, old, path.Base(p)); !bytes.Equal(nd, data) {
+			this.replace[zf.Name] = nd
+		}
+	}
+	return nil
+}
+
+// itemAt returns the manifest item of file 'p', or nil if there is none
+func (this *epubMetadataFile) itemAt(p string) *opfElement {
+	for _, el := range this.editor.items {
+		if q, _ := resolveHref(this.pkg.opfPath, el.getAttr("", "href")); q == p {
+			return el
+		}
+	}
+	return nil
+}
+
+// isPathTaken checks if 'p' is used by an entry or a manifest item
+func (this *epubMetadataFile) isPathTaken(p string) bool {
+	for _, zf := range this.zrc.File {
+		if zf.Name == p && !this.remove[p] {
+			return true
+		}
+	}
+	return this.itemAt(p) != nil
+}
+
+// freePath returns 'p' if it is not used, otherwise a number is appended to
+// the name, like 'cover-1.png'
+func (this *epubMetadataFile) freePath(p string) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; this.isPathTaken(p); i++ {
+		p = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return p
+}
+
+// sameData checks if the data of file 'p' in the EPUB is 'data'
+func (this *epubMetadataFile) sameData(p string, data []byte) (bool, error) {
+	old, e := readFolderFile(this.pkg.folder, p)
+	if os.IsNotExist(e) {
+		return false, nil
+	} else if e != nil {
+		return false, e
+	}
+	return bytes.Equal(old, data), nil
+}
+
+// useAsCover marks manifest item 'el' as the cover image
+func (this *epubMetadataFile) useAsCover(el *opfElement) {
+	attrs := make([]string, 0, 4)
+	id := el.getAttr("", "id")
+	if len(id) == 0 {
+		id = this.editor.newId("cover-image")
+		attrs = append(attrs, "id", id)
+	}
+	if props := el.getAttr("", "properties"); this.editor.version != "2.0" && !containsField(props, "cover-image") {
+		attrs = append(attrs, "properties", strings.TrimSpace(props+" cover-image"))
+	}
+	if len(attrs) > 0 {
+		this.editor.setAttr(el, attrs...)
+	}
+	this.editor.insert(this.editor.metadataEnd, "<meta name=\"cover\" content=\""+html.EscapeString(id)+"\"/>")
+}
+
+// setNcxUid updates 'dtb:uid' of the NCX to the new identifier 'uid'
+func (this *epubMetadataFile) setNcxUid(uid string) error {
+	for _, item := range this.pkg.opf.Items {
+		if item.MediaType != "application/x-dtbncx+xml" {
+			continue
+		}
+		p := this.pkg.itemPath(&item)
+		data, e := readFolderFile(this.pkg.folder, p)
+		if e != nil {
+			return e
+		}
+		this.replace[p] = setNcxUid(data, uid)
+	}
+	return nil
+}
+
+// close closes the original EPUB file, it can be called more than once
+func (this *epubMetadataFile) close() error {
+	if this.zrc == nil {
+		return nil
+	}
+	e := this.zrc.Close()
+	this.zrc = nil
+	return e
+}
+
+// save writes the modified EPUB to replace the original file, entries not
+// modified are copied without being decompressed.
+func (this *epubMetadataFile) save(w io.Writer) error {
+	compressor := epubCompressor{}
+	if e := compressor.init(w, time.Now()); e != nil {
+		return e
+	}
+	for _, zf := range this.zrc.File {
+		if zf.Name == path_of_mimetype || this.remove[zf.Name] {
+			continue
+		}
+		var e error
+		if data, ok := this.replace[zf.Name]; ok {
+			e = compressor.addFile(zf.Name, data)
+		} else {
+			e = compressor.copyEntry(zf)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	for _, p := range this.added {
+		if e := compressor.addFile(p, this.replace[p]); e != nil {
+			return e
+		}
+	}
+	return compressor.close()
+}
+
+// editMetadata modifies the metadata of an EPUB file in place, 'options'
+// is a map from option names to values.
+func editMetadata(inpath string, options map[string]string) error {
+	zrc, e := zip.OpenReader(inpath)
+	if e != nil {
+		return e
+	}
+	this := &epubMetadataFile{
+		path:    inpath,
+		zrc:     zrc,
+		pkg:     &epubPackage{folder: &ZipFolder{zr: &zrc.Reader, name: inpath}},
+		replace: make(map[string][]byte),
+		remove:  make(map[string]bool),
+	}
+	defer this.close()
+
+	if e = this.pkg.loadPackage(); e != nil {
+		return e
+	}
+	opf, e := readFolderFile(this.pkg.folder, this.pkg.opfPath)
+	if e != nil {
+		return e
+	}
+	this.editor = &metadataEditor{opf: opf}
+	if e = this.editor.scan(); e != nil {
+		return fmt.Errorf("failed to parse '%s': %s", this.pkg.opfPath, e.Error())
+	}
+
+	// sort the keys to make the output stable
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "cover" {
+			if e = this.setCover(options[k]); e != nil {
+				return e
+			}
+		} else {
+			this.editor.setMetadata(k, options[k])
+		}
+	}
+	this.editor.touch()
+
+	if id, ok := options["id"]; ok {
+		if e = this.setNcxUid(id); e != nil {
+			return e
+		}
+	}
+	if this.replace[this.pkg.opfPath], e = this.editor.result(); e != nil {
+		return e
+	}
+
+	// the original file must be closed before it is replaced, otherwise the
+	// rename fails on Windows
+	return replaceFile(inpath, func(w io.Writer) error {
+		e := this.save(w)
+		if e1 := this.close(); e == nil {
+			e = e1
+		}
+		return e
+	})
+}
+
+// setMetadataOption sets option 'k' to 'v', an alias is converted to the
+// option it stands for, so the last value wins.
+func setMetadataOption(options map[string]string, k, v string) {
+	if a, ok := metadata_aliases[k]; ok {
+		k = a
+	}
+	options[k] = v
+}
+
+// loadMetadataOptions loads options from the [book] section of an ini file,
+// the path of the cover image is relative to the ini file.
+func loadMetadataOptions(inipath string, options map[string]string) error {
+	cfg, e := OpenIniFile(inipath)
+	if e != nil {
+		return e
+	}
+	// sort the keys to make the result of aliases stable
+	keys := make([]string, 0, len(metadata_options))
+	for k := range metadata_options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := cfg.Lookup("/book/" + k)
+		if !ok {
+			continue
+		}
+		if k == "cover" && !filepath.IsAbs(v) {
+			v = filepath.Join(filepath.Dir(inipath), v)
+		}
+		setMetadataOption(options, k, v)
+	}
+	return nil
+}
+
+func RunEditMetadata() {
+	inpath := getArg(0, "")
+	if len(inpath) == 0 || len(getArg(1, "")) == 0 {
+		onCommandLineError()
+	}
+
+	options := make(map[string]string)
+	for i := 1; ; i++ {
+		arg := getArg(i, "")
+		if len(arg) == 0 {
+			break
+		}
+		if n := strings.Index(arg, "="); n > 0 {
+			k := strings.ToLower(strings.TrimSpace(arg[:n]))
+			if _, ok := metadata_options[k]; !ok {
+				logger.Fatalf("unknown option '%s'.\n", k)
+			}
+			setMetadataOption(options, k, strings.TrimSpace(arg[n+1:]))
+		} else if e := loadMetadataOptions(arg, options); e != nil {
+			logger.Fatalf("failed to load '%s'.\n", arg)
+		}
+	}
+
+	if e := editMetadata(inpath, options); e != nil {
+		logger.Fatalf("failed to modify '%s': %s\n", inpath, e.Error())
+	}
+}
+
+func init() {
+	AddCommandHandler("m", RunEditMetadata)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// xml structures of an existing EPUB package
+
+type xmlContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// a 'dc:xxx' or 'meta' element in the metadata section
+type opfMeta struct {
+	Id       string `xml:"id,attr"`
+	Role     string `xml:"role,attr"`
+	FileAs   string `xml:"file-as,attr"`
+	Event    string `xml:"event,attr"`
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type opfMetadata struct {
+	Identifiers  []opfMeta `xml:"identifier"`
+	Titles       []opfMeta `xml:"title"`
+	Languages    []opfMeta `xml:"language"`
+	Creators     []opfMeta `xml:"creator"`
+	Contributors []opfMeta `xml:"contributor"`
+	Publishers   []opfMeta `xml:"publisher"`
+	Descriptions []opfMeta `xml:"description"`
+	Subjects     []opfMeta `xml:"subject"`
+	Rights       []opfMeta `xml:"rights"`
+	Sources      []opfMeta `xml:"source"`
+	Dates        []opfMeta `xml:"date"`
+	Metas        []opfMeta `xml:"meta"`
+}
+
+type opfItem struct {
+	Id         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type opfItemRef struct {
+	IdRef      string `xml:"idref,attr"`
+	Linear     string `xml:"linear,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type opfReference struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+type opfPackage struct {
+	Version          string      `xml:"version,attr"`
+	UniqueIdentifier string      `xml:"unique-identifier,attr"`
+	Metadata         opfMetadata `xml:"metadata"`
+	Items            []opfItem   `xml:"manifest>item"`
+	Spine            struct {
+		Toc      string       `xml:"toc,attr"`
+		ItemRefs []opfItemRef `xml:"itemref"`
+	} `xml:"spine"`
+	References []opfReference `xml:"guide>reference"`
+}
+
+type ncxNavPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []ncxNavPoint `xml:"navPoint"`
+}
+
+type ncxDocument struct {
+	Metas []struct {
+		Name    string `xml:"name,attr"`
+		Content string `xml:"content,attr"`
+	} `xml:"head>meta"`
+	NavPoints []ncxNavPoint `xml:"navMap>navPoint"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// an item of the table of content of an existing EPUB
+type navEntry struct {
+	Level    int
+	Title    string
+	Path     string // path of the target file in the package
+	Fragment string
+}
+
+// an EPUB package read from an existing file
+type epubPackage struct {
+	folder  VirtualFolder
+	opfPath string // path of the OPF file in the package
+	opf     opfPackage
+	navPath string // path of the navigation document or the NCX
+	toc     []navEntry
+	book    *Epub
+}
+
+func firstMetaValue(metas []opfMeta) string {
+	for _, m := range metas {
+		if v := strings.TrimSpace(m.Value); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// resolveHref resolves 'href' which is relative to file 'base', and returns
+// the path in the package and the fragment, 'path' is empty if 'href' is not
+// a link to a file inside the package.
+func resolveHref(base, href string) (string, string) {
+	u, e := url.Parse(strings.TrimSpace(href))
+	if e != nil || len(u.Scheme) > 0 || len(u.Host) > 0 || strings.HasPrefix(u.Path, "/") {
+		return "", ""
+	}
+	if len(u.Path) == 0 {
+		return base, u.Fragment
+	}
+	return path.Join(path.Dir(base), u.Path), u.Fragment
+}
+
+func readFolderFile(folder VirtualFolder, path string) ([]byte, error) {
+	rc, e := folder.OpenFile(path)
+	if e != nil {
+		return nil, e
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func (this *epubPackage) readXml(path string, v interface{}) error {
+	data, e := readFolderFile(this.folder, path)
+	if e != nil {
+		return e
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func (this *epubPackage) findItem(id string) *opfItem {
+	for i := range this.opf.Items {
+		if this.opf.Items[i].Id == id {
+			return &this.opf.Items[i]
+		}
+	}
+	return nil
+}
+
+func (this *epubPackage) itemPath(item *opfItem) string {
+	p, _ := resolveHref(this.opfPath, item.Href)
+	return p
+}
+
+func (this *epubPackage) loadPackage() error {
+	var container xmlContainer
+	if e := this.readXml(path_of_container_xml, &container); e != nil {
+		return fmt.Errorf("failed to read '%s': %s", path_of_container_xml, e.Error())
+	}
+	for _, rf := range container.Rootfiles {
+		if rf.MediaType == "application/oebps-package+xml" || len(this.opfPath) == 0 {
+			this.opfPath = rf.FullPath
+		}
+	}
+	if len(this.opfPath) == 0 {
+		return fmt.Errorf("no package document is specified in '%s'.", path_of_container_xml)
+	}
+
+	if e := this.readXml(this.opfPath, &this.opf); e != nil {
+		return fmt.Errorf("failed to read '%s': %s", this.opfPath, e.Error())
+	}
+	return nil
+}
+
+func (this *epubPackage) addNcxNavPoints(points []ncxNavPoint, level int) {
+	for _, np := range points {
+		p, frag := resolveHref(this.navPath, np.Content.Src)
+		this.toc = append(this.toc, navEntry{
+			Level:    level,
+			Title:    strings.TrimSpace(np.Label),
+			Path:     p,
+			Fragment: frag,
+		})
+		this.addNcxNavPoints(np.Children, level+1)
+	}
+}
+
+func (this *epubPackage) addNavList(ol *html.Node, level int) {
+	for _, li := range findDirectChildren(ol, atom.Li) {
+		if a := findFirstDirectChild(li, atom.A); a != nil {
+			p, frag := resolveHref(this.navPath, getAttributeValue(a, "href", ""))
+			this.toc = append(this.toc, navEntry{
+				Level:    level,
+				Title:    strings.Join(strings.Fields(nodeText(a)), " "),
+				Path:     p,
+				Fragment: frag,
+			})
+		} else if span := findFirstDirectChild(li, atom.Span); span != nil {
+			this.toc = append(this.toc, navEntry{
+				Level: level,
+				Title: strings.Join(strings.Fields(nodeText(span)), " "),
+			})
+		}
+		if sub := findFirstDirectChild(li, atom.Ol); sub != nil {
+			this.addNavList(sub, level+1)
+		}
+	}
+}
+
+// loadToc reads the table of content from the navigation document of EPUB3,
+// or the NCX of EPUB2 if there's no navigation document.
+func (this *epubPackage) loadToc() error {
+	for i := range this.opf.Items {
+		item := &this.opf.Items[i]
+		if !containsField(item.Properties, "nav") {
+			continue
+		}
+		this.navPath = this.itemPath(item)
+		rc, e := this.folder.OpenFile(this.navPath)
+		if e != nil {
+			return e
+		}
+		doc, e := html.Parse(rc)
+		rc.Close()
+		if e != nil {
+			return e
+		}
+		for _, nav := range findChildren(doc, atom.Nav) {
+			if !containsField(getAttributeValue(nav, "epub:type", ""), "toc") {
+				continue
+			}
+			if ol := findFirstDirectChild(nav, atom.Ol); ol != nil {
+				this.addNavList(ol, 1)
+			}
+			return nil
+		}
+		return fmt.Errorf("no 'toc' nav is found in '%s'.", this.navPath)
+	}
+
+	item := this.findItem(this.opf.Spine.Toc)
+	if item == nil {
+		for i := range this.opf.Items {
+			if this.opf.Items[i].MediaType == "application/x-dtbncx+xml" {
+				item = &this.opf.Items[i]
+				break
+			}
+		}
+	}
+	if item == nil {
+		return fmt.Errorf("neither navigation document nor NCX is found.")
+	}
+
+	this.navPath = this.itemPath(item)
+	var ncx ncxDocument
+	if e := this.readXml(this.navPath, &ncx); e != nil {
+		return e
+	}
+	this.addNcxNavPoints(ncx.NavPoints, 1)
+	return nil
+}
+
+// creator converts a 'dc:creator' or 'dc:contributor' element, role and
+// file-as are attributes in EPUB2, but refinements in EPUB3.
+func (this *epubPackage) creator(m opfMeta, role string) Creator {
+	c := Creator{
+		Name:   strings.TrimSpace(m.Value),
+		Role:   strings.TrimSpace(m.Role),
+		FileAs: strings.TrimSpace(m.FileAs),
+	}
+	if len(m.Id) > 0 {
+		for _, meta := range this.opf.Metadata.Metas {
+			if meta.Refines != "#"+m.Id {
+				continue
+			}
+			if meta.Property == "role" {
+				c.Role = strings.TrimSpace(meta.Value)
+			} else if meta.Property == "file-as" {
+				c.FileAs = strings.TrimSpace(meta.Value)
+			}
+		}
+	}
+	if len(c.Role) == 0 {
+		c.Role = role
+	}
+	return c
+}
+
+// coverPath returns the path of the cover image, which is specified by the
+// 'cover-image' property of EPUB3, or the 'cover' meta of EPUB2.
+func (this *epubPackage) coverPath() string {
+	for i := range this.opf.Items {
+		if containsField(this.opf.Items[i].Properties, "cover-image") {
+			return this.itemPath(&this.opf.Items[i])
+		}
+	}
+	for _, m := range this.opf.Metadata.Metas {
+		if m.Name != "cover" {
+			continue
+		}
+		if item := this.findItem(m.Content); item != nil {
+			return this.itemPath(item)
+		}
+	}
+	return ""
+}
+
+// isCoverPage checks if 'body' of page 'p' only contains cover image 'cover'
+func isCoverPage(cover, p string, body *html.Node) bool {
+	if len(cover) == 0 || len(strings.TrimSpace(nodeText(body))) > 0 {
+		return false
+	}
+	count, others := 0, 0
+	forEachElement(body, func(node *html.Node) {
+		src := ""
+		if node.DataAtom == atom.Img {
+			src = getAttributeValue(node, "src", "")
+		} else if node.Data == "image" && node.Namespace == "svg" {
+			for _, a := range node.Attr {
+				if a.Key == "href" {
+					src = a.Val
+				}
+			}
+		} else {
+			return
+		}
+		if ip, _ := resolveHref(p, src); ip == cover {
+			count++
+		} else {
+			others++
+		}
+	})
+	return count > 0 && others == 0
+}
+
+// loadSeries reads the series from the 'belongs-to-collection' meta of EPUB3,
+// or the 'calibre:series' meta.
+func (this *epubPackage) loadSeries() {
+	var name, index string
+	metas := this.opf.Metadata.Metas
+	for _, m := range metas {
+		if m.Property != "belongs-to-collection" {
+			continue
+		}
+		name = strings.TrimSpace(m.Value)
+		for _, r := range metas {
+			if len(m.Id) > 0 && r.Refines == "#"+m.Id && r.Property == "group-position" {
+				index = strings.TrimSpace(r.Value)
+			}
+		}
+		break
+	}
+	for _, m := range metas {
+		if len(name) == 0 && m.Name == "calibre:series" {
+			name = strings.TrimSpace(m.Content)
+		} else if len(index) == 0 && m.Name == "calibre:series_index" {
+			index = strings.TrimSpace(m.Content)
+		}
+	}
+	if len(name) > 0 {
+		this.book.SetSeries(name, index)
+	}
+}
+
+// loadBook converts the package into the 'Epub' model, files are added in the
+// order of the spine, followed by other files in the manifest.
+func (this *epubPackage) loadBook() error {
+	book := NewEpub(false)
+	this.book = book
+
+	md := &this.opf.Metadata
+	for _, id := range md.Identifiers {
+		if id.Id == this.opf.UniqueIdentifier {
+			book.SetId(strings.TrimSpace(id.Value))
+		}
+	}
+	book.SetName(firstMetaValue(md.Titles))
+	for _, m := range md.Creators {
+		book.AddCreator(this.creator(m, "aut"))
+	}
+	for _, m := range md.Contributors {
+		book.AddContributor(this.creator(m, "ctb"))
+	}
+	book.SetPublisher(firstMetaValue(md.Publishers))
+	book.SetDescription(firstMetaValue(md.Descriptions))
+	book.SetLanguage(firstMetaValue(md.Languages))
+	book.SetRights(firstMetaValue(md.Rights))
+	book.SetSource(firstMetaValue(md.Sources))
+	for _, m := range md.Subjects {
+		if v := strings.TrimSpace(m.Value); len(v) > 0 {
+			book.AddSubject(v)
+		}
+	}
+	for _, m := range md.Dates {
+		if m.Event == "" || m.Event == "publication" {
+			book.SetDate(strings.TrimSpace(m.Value))
+			break
+		}
+	}
+	this.loadSeries()
+
+	files := make(map[string]*File)
+	addFile := func(item *opfItem, attr int) {
+		p := this.itemPath(item)
+		if _, ok := files[p]; ok || len(p) == 0 {
+			return
+		}
+		// data is read on demand, but skip the file if it does not exist
+		rc, e := this.folder.OpenFile(p)
+		if e != nil {
+			return
+		}
+		rc.Close()
+		if p == this.navPath {
+			attr |= epub_INTERNAL_FILE
+		}
+		f := &File{
+			Path:       p,
+			Attr:       attr,
+			MediaType:  strings.TrimSpace(item.MediaType),
+			Properties: strings.TrimSpace(item.Properties),
+			folder:     this.folder,
+		}
+		files[p] = f
+		book.files = append(book.files, f)
+	}
+
+	for _, ir := range this.opf.Spine.ItemRefs {
+		item := this.findItem(ir.IdRef)
+		if item == nil {
+			continue
+		}
+		attr := epub_CONTENT_FILE
+		if ir.Linear == "no" {
+			attr |= epub_NON_LINEAR_PAGE
+		}
+		if containsField(ir.Properties, "duokan-page-fullscreen") {
+			attr |= epub_FULL_SCREEN_PAGE
+		}
+		addFile(item, attr)
+	}
+	for i := range this.opf.Items {
+		addFile(&this.opf.Items[i], epub_NORMAL_FILE)
+	}
+
+	for _, ne := range this.toc {
+		f, ok := files[ne.Path]
+		if !ok || (f.Attr&epub_CONTENT_FILE) == 0 {
+			continue
+		}
+		c := Chapter{Level: ne.Level, Title: ne.Title}
+		if len(ne.Fragment) > 0 {
+			c.Link = "#" + ne.Fragment
+		}
+		f.Chapters = append(f.Chapters, c)
+	}
+
+	return nil
+}
+
+func readEpub(folder VirtualFolder) (*epubPackage, error) {
+	this := &epubPackage{folder: folder}
+	if e := this.loadPackage(); e != nil {
+		return nil, e
+	}
+	if e := this.loadToc(); e != nil {
+		return nil, e
+	}
+	if e := this.loadBook(); e != nil {
+		return nil, e
+	}
+	return this, nil
+}
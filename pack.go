@@ -1,32 +1,13 @@
 package main
 
 import (
-	"io/ioutil"
 	"os"
 )
 
-func packFiles(book *Epub, input string) error {
-	folder, e := OpenVirtualFolder(input)
-	if e != nil {
-		logger.Println("failed to open source folder/file.\n")
-		return e
-	}
-
+func packFiles(book *Epub, folder VirtualFolder) error {
 	walk := func(path string) error {
-		rc, e := folder.OpenFile(path)
-		if e != nil {
-			logger.Println("failed to open file: ", path)
-			return e
-		}
-		defer rc.Close()
-		data, e := ioutil.ReadAll(rc)
-		if e != nil {
-			logger.Println("failed reading file: ", path)
-			return e
-		}
-
-		book.AddFile(path, data)
-		return e
+		book.AddFolderFile(folder, path)
+		return nil
 	}
 
 	return folder.Walk(walk)
@@ -38,13 +19,22 @@ func RunPack() {
 		onCommandLineError()
 	}
 
+	folder, e := OpenVirtualFolder(inpath)
+	if e != nil {
+		logger.Fatalln("failed to open source folder/file.")
+	}
+
 	book := NewEpub(false)
 
-	if packFiles(book, inpath) != nil {
+	if packFiles(book, folder) != nil {
+		folder.Close()
 		os.Exit(1)
 	}
 
-	if book.Save(outpath, EPUB_VERSION_NONE) != nil {
+	// files are read from the folder while saving
+	e = book.Save(outpath, EPUB_VERSION_NONE)
+	folder.Close()
+	if e != nil {
 		logger.Fatalln("failed to create output file: ", outpath)
 	}
 }
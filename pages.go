@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	path_of_title_page     = "title_page.xhtml"
+	path_of_copyright_page = "copyright_page.xhtml"
+	path_of_colophon       = "colophon.xhtml"
+
+	// name of the option to use the built-in template
+	default_template = "default"
+
+	default_title_page = `<html lang="{{.Language}}">
+<head>
+<title>{{.Name}}</title>
+<style type="text/css">
+div.makeepub-title-page { text-align: center; margin-top: 30%; }
+div.makeepub-title-page p.series { font-style: italic; }
+div.makeepub-title-page p.publisher { margin-top: 5em; }
+</style>
+</head>
+<body>
+<div class="makeepub-title-page">
+<h1>{{.Name}}</h1>
+{{with .Series}}<p class="series">{{.}}{{with $.SeriesIndex}} {{.}}{{end}}</p>{{end}}
+{{range .Creators}}<p class="creator">{{.Name}}</p>
+{{end}}
+{{with .Publisher}}<p class="publisher">{{.}}</p>{{end}}
+</div>
+</body>
+</html>`
+
+	default_copyright_page = `<html lang="{{.Language}}">
+<head>
+<title>{{.Name}}</title>
+<style type="text/css">
+div.makeepub-copyright-page p { margin: 0.3em 0; text-indent: 0; }
+</style>
+</head>
+<body>
+<div class="makeepub-copyright-page">
+<p><b>{{.Name}}</b></p>
+{{range .Creators}}<p>{{role .Role}}: {{.Name}}</p>
+{{end}}
+{{range .Contributors}}<p>{{role .Role}}: {{.Name}}</p>
+{{end}}
+{{with .Publisher}}<p>Publisher: {{.}}</p>{{end}}
+{{with .Date}}<p>Published: {{.}}</p>{{end}}
+{{with .Source}}<p>Source: {{.}}</p>{{end}}
+<p>Identifier: {{.Id}}</p>
+{{with .Rights}}<p>{{.}}</p>{{end}}
+</div>
+</body>
+</html>`
+
+	default_colophon = `<html lang="{{.Language}}">
+<head>
+<title>About This Edition</title>
+</head>
+<body>
+<div class="makeepub-colophon">
+<h2>About This Edition</h2>
+<p>This {{with .EpubVersion}}EPUB {{.}} {{end}}edition of <i>{{.Name}}</i> was made with makeepub v{{.Version}} on {{.BuildTime.Format "2006-01-02"}}.</p>
+{{with .Description}}<p>{{.}}</p>{{end}}
+</div>
+</body>
+</html>`
+)
+
+var (
+	marc_relators = map[string]string{
+		"aut": "Author",
+		"ctb": "Contributor",
+		"edt": "Editor",
+		"ill": "Illustrator",
+		"nrt": "Narrator",
+		"pht": "Photographer",
+		"trl": "Translator",
+	}
+
+	template_funcs = template.FuncMap{
+		// role converts a MARC relator code to its name
+		"role": func(code string) string {
+			if name, ok := marc_relators[code]; ok {
+				return name
+			}
+			return code
+		},
+	}
+)
+
+// the data passed to the templates of the pages, metadata is provided by the
+// methods of 'Epub', like '{{.Name}}' and '{{.Author}}'
+type templateData struct {
+	*Epub
+	Version     string    // version of makeepub
+	EpubVersion string    // '2.0', '3.0', or empty if no package documents
+	BuildTime   time.Time // the time when the book is built
+}
+
+// parsePageTemplate parses template 'data' of a page, the built-in template
+// 'dflt' is used if 'data' is nil.
+func parsePageTemplate(name string, data []byte, dflt string) (*template.Template, error) {
+	text := dflt
+	if data != nil {
+		text = string(removeUtf8Bom(data))
+	}
+	return template.New(name).Funcs(template_funcs).Parse(text)
+}
+
+// AddTemplatePage adds page 'path' before content file 'before', or to the
+// end if 'before' is nil. The page is generated from 'tmpl' when the book is
+// built, so it can use all the metadata and the build information.
+func (this *Epub) AddTemplatePage(path string, tmpl *template.Template, before *File) {
+	f := &File{Path: path, Attr: epub_CONTENT_FILE | epub_TEMPLATE_PAGE}
+	this.insertFile(f, before)
+	if this.templates == nil {
+		this.templates = make(map[*File]*template.Template)
+	}
+	this.templates[f] = tmpl
+}
+
+// renderTemplatePages generates the data of the pages added by
+// 'AddTemplatePage', the output of the templates is converted to XHTML.
+func (this *Epub) renderTemplatePages(ver int, modified time.Time) error {
+	data := templateData{Epub: this, Version: version, BuildTime: modified}
+	switch ver {
+	case EPUB_VERSION_200:
+		data.EpubVersion = "2.0"
+	case EPUB_VERSION_300:
+		data.EpubVersion = "3.0"
+	}
+
+	for _, f := range this.files {
+		tmpl, ok := this.templates[f]
+		if !ok {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if e := tmpl.Execute(buf, data); e != nil {
+			return e
+		}
+		root, e := html.Parse(buf)
+		if e != nil {
+			return e
+		}
+		buf.Reset()
+		if e = renderXhtml(buf, root); e != nil {
+			return e
+		}
+		f.Data = buf.Bytes()
+	}
+	return nil
+}
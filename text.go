@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	default_chapter_pattern = `^(第[0-9０-９一二三四五六七八九十百千零〇两]+[章回]|Chapter\s*[0-9]+)`
+)
+
+// a rule to detect chapter titles in plain text
+type textRule struct {
+	level   int
+	pattern *regexp.Regexp
+}
+
+func isIndented(line string) bool {
+	r, _ := utf8.DecodeRuneInString(line)
+	return unicode.IsSpace(r)
+}
+
+// textToHtml converts plain text into a complete html document. Paragraphs are
+// separated by blank lines or indented lines, and a line which matches one of
+// the 'rules' and is not longer than 'maxTitle' runes becomes a header.
+func textToHtml(src []byte, title string, css []string, rules []textRule, maxTitle int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writeHtmlHead(buf, title, css)
+
+	para := ""
+	flush := func() {
+		if len(para) > 0 {
+			buf.WriteString("<p>" + html.EscapeString(para) + "</p>\n")
+			para = ""
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(removeUtf8Bom(src)))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRightFunc(scanner.Text(), unicode.IsSpace)
+		s := strings.TrimSpace(line)
+		if len(s) == 0 {
+			flush()
+			continue
+		}
+
+		if level := matchTextRule(s, rules, maxTitle); level > 0 {
+			flush()
+			fmt.Fprintf(buf, "<h%d>%s</h%d>\n", level, html.EscapeString(s), level)
+			continue
+		}
+
+		if isIndented(line) {
+			flush()
+		}
+		if len(para) == 0 {
+			para = s
+			continue
+		}
+
+		// need a white space? the same rule as multi-line values in book.ini
+		if c, _ := utf8.DecodeLastRuneInString(para); c < 128 && c != '-' && s[0] < 128 {
+			para += " " + s
+		} else {
+			para += s
+		}
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, e
+	}
+	flush()
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
+
+func matchTextRule(line string, rules []textRule, maxTitle int) int {
+	if utf8.RuneCountInString(line) > maxTitle {
+		return 0
+	}
+	for _, r := range rules {
+		if r.pattern.MatchString(line) {
+			return r.level
+		}
+	}
+	return 0
+}
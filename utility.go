@@ -1,13 +1,66 @@
 package main
 
 import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
 
+// the name space for UUIDs generated from URLs, see RFC 4122
+var uuid_namespace_url = []byte{
+	0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1,
+	0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+}
+
+// uuidV5 generates a name based UUID with SHA-1, see RFC 4122
+func uuidV5(namespace []byte, name string) string {
+	h := sha1.New()
+	h.Write(namespace)
+	h.Write([]byte(name))
+	sum := h.Sum(nil)
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// replaceFile writes the new content of file 'path' with 'write' to a
+// temporary file, and renames it to 'path' after success, so the original
+// file is kept if anything goes wrong, and it can be read while writing.
+func replaceFile(path string, write func(w io.Writer) error) error {
+	f, e := ioutil.TempFile(filepath.Dir(path), ".makeepub-")
+	if e != nil {
+		return e
+	}
+	tmp := f.Name()
+
+	mode := os.FileMode(0644)
+	if fi, e := os.Stat(path); e == nil {
+		mode = fi.Mode()
+	}
+	if e = f.Chmod(mode); e == nil {
+		e = write(f)
+	}
+	if e1 := f.Close(); e == nil {
+		e = e1
+	}
+	if e == nil {
+		e = os.Rename(tmp, path)
+	}
+	if e != nil {
+		os.Remove(tmp)
+	}
+	return e
+}
+
 func removeUtf8Bom(data []byte) []byte {
 	if len(data) > 3 && data[0] == 0xEF && data[1] == 0xBB && data[2] == 0xBF {
 		data = data[3:]
@@ -15,6 +68,76 @@ func removeUtf8Bom(data []byte) []byte {
 	return data
 }
 
+// parseDate parses a date or time in format 'YYYY', 'YYYY-MM', 'YYYY-MM-DD',
+// 'YYYY-MM-DD hh:mm:ss' or RFC3339, time zone is UTC if not specified.
+func parseDate(s string) (time.Time, error) {
+	layouts := []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05",
+		"2006-01-02",
+		"2006-01",
+		"2006",
+	}
+	var e error
+	for _, layout := range layouts {
+		var t time.Time
+		if t, e = time.Parse(layout, s); e == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, e
+}
+
+// formatDate converts date 's' to W3CDTF with the precision given in 's', it
+// can be in any format accepted by 'parseDate', and time is converted to UTC.
+func formatDate(s string) (string, error) {
+	t, e := parseDate(s)
+	if e != nil {
+		return "", e
+	}
+	switch len(s) {
+	case len("2006"):
+		return t.Format("2006"), nil
+	case len("2006-01"):
+		return t.Format("2006-01"), nil
+	case len("2006-01-02"):
+		return t.Format("2006-01-02"), nil
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z"), nil
+}
+
+// naturalLess compares strings in natural order, that is, digits are
+// compared by their numeric values, so 'part2' is less than 'part10'.
+func naturalLess(a, b string) bool {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	for len(a) > 0 && len(b) > 0 {
+		if !isDigit(a[0]) || !isDigit(b[0]) {
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		i, j := 0, 0
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		na, nb := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+		a, b = a[i:], b[j:]
+	}
+	return len(a) < len(b)
+}
+
 func containsField(str, field string) bool {
 	for _, f := range strings.Fields(str) {
 		if f == field {
@@ -83,6 +206,60 @@ func findChildren(parent *html.Node, a atom.Atom) (result []*html.Node) {
 	return
 }
 
+func forEachElement(parent *html.Node, fn func(node *html.Node)) {
+	for node := parent.FirstChild; node != nil; node = node.NextSibling {
+		if node.Type == html.ElementNode {
+			fn(node)
+			forEachElement(node, fn)
+		}
+	}
+}
+
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	text := ""
+	for n := node.FirstChild; n != nil; n = n.NextSibling {
+		text += nodeText(n)
+	}
+	return text
+}
+
+// headingText returns the text of a heading for the TOC: text of all the
+// descendants is joined, '<br>' is taken as a space, ruby annotations are
+// removed if 'ruby' is false, and white spaces are normalized. The 'alt' of
+// images is used if there's no text.
+func headingText(node *html.Node, ruby bool) string {
+	text, alt := "", ""
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			if n.Type == html.TextNode {
+				text += n.Data
+			} else if n.Type != html.ElementNode {
+				continue
+			} else if n.DataAtom == atom.Br {
+				text += " "
+			} else if n.DataAtom == atom.Img {
+				alt += " " + getAttributeValue(n, "alt", "")
+			} else if n.DataAtom == atom.Rt || n.DataAtom == atom.Rp {
+				if ruby {
+					walk(n)
+				}
+			} else if n.DataAtom != atom.Script && n.DataAtom != atom.Style {
+				walk(n)
+			}
+		}
+	}
+	walk(node)
+
+	if text = strings.Join(strings.Fields(text), " "); len(text) == 0 {
+		text = strings.Join(strings.Fields(alt), " ")
+	}
+	return text
+}
+
 func findAttribute(node *html.Node, name string) *html.Attribute {
 	for i := 0; i < len(node.Attr); i++ {
 		if node.Attr[i].Key == name {
@@ -118,7 +295,9 @@ func hasClass(node *html.Node, class string) bool {
 
 func addClass(node *html.Node, class string) {
 	if attr := findAttribute(node, "class"); attr != nil {
-		if !containsField(attr.Val, class) {
+		if len(strings.TrimSpace(attr.Val)) == 0 {
+			attr.Val = class
+		} else if !containsField(attr.Val, class) {
 			attr.Val = class + " " + attr.Val
 		}
 	} else {
@@ -142,7 +321,29 @@ func removeClass(node *html.Node, class string) {
 			classes = classes + " " + c
 		}
 	}
-	attr.Val = classes
+	if len(classes) == 0 {
+		removeAttribute(node, "class")
+	} else {
+		attr.Val = classes
+	}
+}
+
+func newElement(a atom.Atom, attr ...html.Attribute) *html.Node {
+	return &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: a,
+		Data:     a.String(),
+		Attr:     attr,
+	}
+}
+
+// cloneTree clones 'node' and all its descendants
+func cloneTree(node *html.Node) *html.Node {
+	n := cloneNode(node)
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		n.AppendChild(cloneTree(c))
+	}
+	return n
 }
 
 func cloneNode(node *html.Node) *html.Node {
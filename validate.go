@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+type epubValidator struct {
+	pkg      *epubPackage
+	zr       *zip.Reader
+	entries  map[string]*zip.File
+	ids      map[string]map[string]bool // ids of elements in content files
+	errors   int
+	warnings int
+	issues   int // issue count when current section starts
+}
+
+// section starts a new section of the report, 'OK' is printed for the
+// previous section if it found no issue.
+func (this *epubValidator) section(name string) {
+	if this.issues == this.errors+this.warnings {
+		fmt.Println("  OK")
+	}
+	this.issues = this.errors + this.warnings
+	if len(name) > 0 {
+		fmt.Printf("[%s]\n", name)
+	}
+}
+
+func (this *epubValidator) error(format string, a ...interface{}) {
+	this.errors++
+	fmt.Printf("  ERROR  : "+format+"\n", a...)
+}
+
+func (this *epubValidator) warning(format string, a ...interface{}) {
+	this.warnings++
+	fmt.Printf("  WARNING: "+format+"\n", a...)
+}
+
+func (this *epubValidator) checkMimetype() {
+	this.section("mimetype")
+	if len(this.zr.File) == 0 {
+		this.error("the package is empty.")
+		return
+	}
+
+	zf := this.zr.File[0]
+	if zf.Name != path_of_mimetype {
+		this.error("the first entry is '%s' instead of '%s'.", zf.Name, path_of_mimetype)
+		return
+	}
+	if zf.Method != zip.Store {
+		this.error("'%s' is compressed.", path_of_mimetype)
+	}
+	if len(zf.Extra) > 0 {
+		this.warning("'%s' has extra field.", path_of_mimetype)
+	}
+
+	if rc, e := zf.Open(); e != nil {
+		this.error("failed to read '%s'.", path_of_mimetype)
+	} else {
+		data := make([]byte, 64)
+		n, _ := rc.Read(data)
+		rc.Close()
+		if string(data[:n]) != "application/epub+zip" {
+			this.error("content of '%s' is '%s'.", path_of_mimetype, string(data[:n]))
+		}
+	}
+}
+
+// checkEntries checks the names of the zip entries, readers may pick any of
+// the entries with the same name.
+func (this *epubValidator) checkEntries() {
+	this.section("entries")
+	names := make(map[string]bool)
+	for _, zf := range this.zr.File {
+		if names[zf.Name] {
+			this.error("duplicated entry '%s'.", zf.Name)
+		}
+		names[zf.Name] = true
+	}
+}
+
+// uniqueIdentifier returns the value of the unique identifier of the package
+func (this *epubValidator) uniqueIdentifier() string {
+	opf := &this.pkg.opf
+	for _, id := range opf.Metadata.Identifiers {
+		if len(opf.UniqueIdentifier) > 0 && id.Id == opf.UniqueIdentifier {
+			return strings.TrimSpace(id.Value)
+		}
+	}
+	return ""
+}
+
+func (this *epubValidator) checkPackage() bool {
+	this.section("package")
+	if e := this.pkg.loadPackage(); e != nil {
+		this.error("%s", e.Error())
+		return false
+	}
+	if _, ok := this.entries[this.pkg.opfPath]; !ok {
+		this.error("package document '%s' does not exist.", this.pkg.opfPath)
+		return false
+	}
+
+	opf := &this.pkg.opf
+	if opf.Version != "2.0" && !strings.HasPrefix(opf.Version, "3.") {
+		this.error("unsupported version '%s'.", opf.Version)
+	}
+
+	if len(opf.UniqueIdentifier) == 0 {
+		this.error("attribute 'unique-identifier' is missing.")
+	} else {
+		found := false
+		for _, id := range opf.Metadata.Identifiers {
+			if id.Id != opf.UniqueIdentifier {
+				continue
+			}
+			found = true
+			if len(strings.TrimSpace(id.Value)) == 0 {
+				this.error("unique identifier '%s' is empty.", id.Id)
+			}
+		}
+		if !found {
+			this.error("unique identifier '%s' does not exist.", opf.UniqueIdentifier)
+		}
+	}
+
+	if len(firstMetaValue(opf.Metadata.Titles)) == 0 {
+		this.error("'dc:title' is missing or empty.")
+	}
+	if len(firstMetaValue(opf.Metadata.Languages)) == 0 {
+		this.error("'dc:language' is missing or empty.")
+	}
+
+	for _, m := range opf.Metadata.Metas {
+		if m.Name == "cover" && this.pkg.findItem(m.Content) == nil {
+			this.warning("cover '%s' is not the id of a manifest item.", m.Content)
+		}
+	}
+
+	return true
+}
+
+func (this *epubValidator) checkManifest() {
+	this.section("manifest")
+	items := make(map[string]bool)
+	paths := make(map[string]bool)
+
+	for i := range this.pkg.opf.Items {
+		item := &this.pkg.opf.Items[i]
+		if items[item.Id] {
+			this.error("duplicated item id '%s'.", item.Id)
+		}
+		items[item.Id] = true
+
+		p := this.pkg.itemPath(item)
+		if len(p) == 0 {
+			continue // remote resource
+		}
+		if paths[p] {
+			this.error("duplicated href '%s' of item '%s'.", p, item.Id)
+		}
+		paths[p] = true
+		if _, ok := this.entries[p]; !ok {
+			this.error("item '%s' does not exist: '%s'.", item.Id, p)
+		}
+		if len(item.MediaType) == 0 {
+			this.error("item '%s' has no media type.", item.Id)
+		}
+	}
+
+	for _, zf := range this.zr.File {
+		name := zf.Name
+		if name == path_of_mimetype || name == this.pkg.opfPath ||
+			strings.HasPrefix(name, "META-INF/") || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if !paths[name] {
+			this.warning("'%s' is not declared in the manifest.", name)
+		}
+	}
+}
+
+func (this *epubValidator) checkSpine() {
+	this.section("spine")
+	opf := &this.pkg.opf
+	if len(opf.Spine.ItemRefs) == 0 {
+		this.error("spine is empty.")
+	}
+	for _, ir := range opf.Spine.ItemRefs {
+		if this.pkg.findItem(ir.IdRef) == nil {
+			this.error("itemref '%s' does not refer to a manifest item.", ir.IdRef)
+		}
+	}
+	if len(opf.Spine.Toc) > 0 && this.pkg.findItem(opf.Spine.Toc) == nil {
+		this.error("toc '%s' does not refer to a manifest item.", opf.Spine.Toc)
+	}
+}
+
+// elementIds returns the ids of all elements of a content file
+func (this *epubValidator) elementIds(p string) map[string]bool {
+	if ids, ok := this.ids[p]; ok {
+		return ids
+	}
+	ids := make(map[string]bool)
+	if rc, e := this.pkg.folder.OpenFile(p); e == nil {
+		if doc, e := html.Parse(rc); e == nil {
+			forEachElement(doc, func(node *html.Node) {
+				if id := getAttributeValue(node, "id", ""); len(id) > 0 {
+					ids[id] = true
+				}
+			})
+		}
+		rc.Close()
+	}
+	this.ids[p] = ids
+	return ids
+}
+
+func (this *epubValidator) checkNavigation() {
+	this.section("navigation")
+	if e := this.pkg.loadToc(); e != nil {
+		this.error("%s", e.Error())
+		return
+	}
+	if strings.HasPrefix(this.pkg.opf.Version, "3.") && path.Ext(this.pkg.navPath) == ".ncx" {
+		this.error("navigation document is missing.")
+	}
+	if len(this.pkg.toc) == 0 {
+		this.warning("table of content is empty.")
+	}
+	this.checkNcxUid()
+
+	for _, ne := range this.pkg.toc {
+		if len(ne.Path) == 0 {
+			continue
+		}
+		if _, ok := this.entries[ne.Path]; !ok {
+			this.error("link of '%s' refers to a nonexistent file '%s'.", ne.Title, ne.Path)
+		} else if len(ne.Fragment) > 0 && !this.elementIds(ne.Path)[ne.Fragment] {
+			this.error("link of '%s' refers to a nonexistent fragment '%s#%s'.", ne.Title, ne.Path, ne.Fragment)
+		}
+	}
+}
+
+// checkNcxUid checks if 'dtb:uid' of the NCX, which may exist in EPUB3 books
+// for compatibility, is the same as the unique identifier of the package.
+func (this *epubValidator) checkNcxUid() {
+	item := this.pkg.findItem(this.pkg.opf.Spine.Toc)
+	for i := 0; item == nil && i < len(this.pkg.opf.Items); i++ {
+		if this.pkg.opf.Items[i].MediaType == "application/x-dtbncx+xml" {
+			item = &this.pkg.opf.Items[i]
+		}
+	}
+	if item == nil {
+		return
+	}
+
+	p := this.pkg.itemPath(item)
+	var ncx ncxDocument
+	if e := this.pkg.readXml(p, &ncx); e != nil {
+		this.error("failed to read NCX '%s': %s", p, e.Error())
+		return
+	}
+	for _, m := range ncx.Metas {
+		if m.Name != "dtb:uid" {
+			continue
+		}
+		if uid := this.uniqueIdentifier(); strings.TrimSpace(m.Content) != uid {
+			this.error("'dtb:uid' of '%s' is '%s', but the unique identifier is '%s'.", p, m.Content, uid)
+		}
+		return
+	}
+	this.error("'dtb:uid' is missing in '%s'.", p)
+}
+
+// checkContent verifies the content files of the book model, which is built
+// from the spine.
+func (this *epubValidator) checkContent() {
+	this.section("content")
+	if e := this.pkg.loadBook(); e != nil {
+		this.error("%s", e.Error())
+		return
+	}
+	count := 0
+	for _, f := range this.pkg.book.files {
+		if (f.Attr & epub_CONTENT_FILE) == 0 {
+			continue
+		}
+		count++
+		if mt := getMediaType(f.Path); mt != "application/xhtml+xml" {
+			this.warning("content file '%s' has media type '%s'.", f.Path, mt)
+		}
+	}
+	if count == 0 {
+		this.error("there is no readable content file.")
+	}
+}
+
+func validateEpub(inpath string) (int, int, error) {
+	zrc, e := zip.OpenReader(inpath)
+	if e != nil {
+		return 0, 0, e
+	}
+	defer zrc.Close()
+
+	this := &epubValidator{
+		zr:      &zrc.Reader,
+		entries: make(map[string]*zip.File),
+		ids:     make(map[string]map[string]bool),
+	}
+	for _, zf := range this.zr.File {
+		this.entries[zf.Name] = zf
+	}
+	this.pkg = &epubPackage{folder: &ZipFolder{zr: this.zr, name: inpath}}
+
+	fmt.Printf("validating '%s'\n", inpath)
+	this.issues = -1
+	this.checkMimetype()
+	this.checkEntries()
+	if this.checkPackage() {
+		this.checkManifest()
+		this.checkSpine()
+		this.checkNavigation()
+		this.checkContent()
+	}
+	this.section("")
+	fmt.Printf("summary: %d error(s), %d warning(s)\n", this.errors, this.warnings)
+
+	return this.errors, this.warnings, nil
+}
+
+func RunValidate() {
+	inpath := getArg(0, "")
+	if len(inpath) == 0 {
+		onCommandLineError()
+	}
+
+	errors, _, e := validateEpub(inpath)
+	if e != nil {
+		logger.Fatalf("failed to open '%s'.\n", inpath)
+	}
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	AddCommandHandler("v", RunValidate)
+}
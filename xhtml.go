@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	xmlns_xhtml  = "http://www.w3.org/1999/xhtml"
+	xmlns_epub   = "http://www.idpf.org/2007/ops"
+	xmlns_svg    = "http://www.w3.org/2000/svg"
+	xmlns_mathml = "http://www.w3.org/1998/Math/MathML"
+	xmlns_xlink  = "http://www.w3.org/1999/xlink"
+)
+
+var (
+	void_elements = map[string]bool{
+		"area": true, "base": true, "br": true, "col": true, "embed": true,
+		"hr": true, "img": true, "input": true, "keygen": true, "link": true,
+		"meta": true, "param": true, "source": true, "track": true, "wbr": true,
+	}
+
+	// a self-closing tag, like '<a id="x"/>'
+	self_closing_tag = regexp.MustCompile(`<([a-zA-Z][-.:\w]*)((?:\s+[^\s/>"'=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'>]+))?)*)\s*/>`)
+
+	boolean_attributes = map[string]bool{
+		"async": true, "autofocus": true, "autoplay": true, "checked": true,
+		"controls": true, "default": true, "defer": true, "disabled": true,
+		"hidden": true, "ismap": true, "loop": true, "multiple": true,
+		"muted": true, "nomodule": true, "novalidate": true, "open": true,
+		"readonly": true, "required": true, "reversed": true, "selected": true,
+	}
+)
+
+// characters which are invisible or easy to be confused with others, they
+// are written as numeric character references to keep the output readable.
+func needCharRef(r rune) bool {
+	return r == 0xA0 || r == 0xAD || (r >= 0x2000 && r <= 0x200F) ||
+		r == 0x2028 || r == 0x2029 || r == 0x202F || r == 0xFEFF
+}
+
+func isXmlChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		(r >= 0x20 && r <= 0xD7FF) ||
+		(r >= 0xE000 && r <= 0xFFFD) ||
+		(r >= 0x10000 && r <= 0x10FFFF)
+}
+
+func isXmlName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r > 0x7F {
+			continue
+		}
+		if i > 0 && (r == '-' || r == '.' || (r >= '0' && r <= '9')) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func escapeXml(buf *bytes.Buffer, s string, attr bool) {
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			r = 0xFFFD
+		}
+		s = s[size:]
+		switch {
+		case r == '&':
+			buf.WriteString("&amp;")
+		case r == '<':
+			buf.WriteString("&lt;")
+		case r == '>':
+			buf.WriteString("&gt;")
+		case r == '"' && attr:
+			buf.WriteString("&quot;")
+		case needCharRef(r):
+			buf.WriteString("&#" + strconv.Itoa(int(r)) + ";")
+		case isXmlChar(r):
+			buf.WriteRune(r)
+		}
+	}
+}
+
+type xhtmlRenderer struct {
+	buf  *bytes.Buffer
+	epub bool // if the 'epub' namespace is used
+}
+
+func (this *xhtmlRenderer) attrName(node *html.Node, attr *html.Attribute) string {
+	name := attr.Key
+	if len(attr.Namespace) > 0 {
+		name = attr.Namespace + ":" + name
+	}
+	if name == "xmlns" || strings.HasPrefix(name, "xmlns:") || !isXmlName(name) {
+		return ""
+	}
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		switch name[:i] {
+		case "xml", "epub":
+		case "xlink":
+			if len(node.Namespace) == 0 {
+				return ""
+			}
+		default: // prefix is not bound to any namespace
+			return ""
+		}
+	}
+	return name
+}
+
+func (this *xhtmlRenderer) renderElement(node *html.Node) {
+	buf := this.buf
+	buf.WriteByte('<')
+	buf.WriteString(node.Data)
+
+	if node.DataAtom == atom.Html && len(node.Namespace) == 0 {
+		buf.WriteString(" xmlns=\"" + xmlns_xhtml + "\"")
+		if this.epub {
+			buf.WriteString(" xmlns:epub=\"" + xmlns_epub + "\"")
+		}
+	} else if p := node.Parent; p == nil || p.Namespace != node.Namespace {
+		if node.Namespace == "svg" {
+			buf.WriteString(" xmlns=\"" + xmlns_svg + "\" xmlns:xlink=\"" + xmlns_xlink + "\"")
+		} else if node.Namespace == "math" {
+			buf.WriteString(" xmlns=\"" + xmlns_mathml + "\"")
+		} else if len(node.Namespace) == 0 && p != nil {
+			buf.WriteString(" xmlns=\"" + xmlns_xhtml + "\"")
+		}
+	}
+
+	for i := 0; i < len(node.Attr); i++ {
+		attr := &node.Attr[i]
+		name := this.attrName(node, attr)
+		if len(name) == 0 {
+			continue
+		}
+		val := attr.Val
+		if len(val) == 0 && len(node.Namespace) == 0 && boolean_attributes[name] {
+			val = name
+		}
+		buf.WriteString(" " + name + "=\"")
+		escapeXml(buf, val, true)
+		buf.WriteByte('"')
+	}
+
+	if void_elements[node.Data] && len(node.Namespace) == 0 {
+		buf.WriteString("/>")
+		return
+	}
+	buf.WriteByte('>')
+
+	if len(node.Namespace) == 0 && (node.DataAtom == atom.Script || node.DataAtom == atom.Style) {
+		this.renderRawText(node)
+	} else {
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			this.renderNode(n)
+		}
+	}
+
+	buf.WriteString("</" + node.Data + ">")
+}
+
+// the content of 'script' and 'style' elements are not escaped by the html
+// parser, put them into a CDATA section if they contain special characters.
+func (this *xhtmlRenderer) renderRawText(node *html.Node) {
+	text := ""
+	for n := node.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type == html.TextNode {
+			text += n.Data
+		}
+	}
+	if !strings.ContainsAny(text, "<&") {
+		escapeXml(this.buf, text, false)
+		return
+	}
+	text = strings.Replace(text, "]]>", "]]]]><![CDATA[>", -1)
+	if node.DataAtom == atom.Script {
+		this.buf.WriteString("//<![CDATA[\n" + text + "\n//]]>")
+	} else {
+		this.buf.WriteString("/*<![CDATA[*/\n" + text + "\n/*]]>*/")
+	}
+}
+
+func (this *xhtmlRenderer) renderNode(node *html.Node) {
+	switch node.Type {
+	case html.ElementNode:
+		this.renderElement(node)
+	case html.TextNode:
+		escapeXml(this.buf, node.Data, false)
+	case html.CommentNode:
+		s := strings.Replace(node.Data, "--", "- -", -1)
+		if strings.HasSuffix(s, "-") {
+			s += " "
+		}
+		this.buf.WriteString("<!--")
+		escapeXml(this.buf, s, false)
+		this.buf.WriteString("-->")
+	case html.DocumentNode:
+		for n := node.FirstChild; n != nil; n = n.NextSibling {
+			this.renderNode(n)
+		}
+	}
+}
+
+// renderXhtml writes the tree rooted at 'node' as a well-formed XHTML document,
+// 'node' is either a document node or an 'html' element.
+func renderXhtml(w io.Writer, node *html.Node) error {
+	this := &xhtmlRenderer{buf: new(bytes.Buffer)}
+
+	forEachElement(node, func(n *html.Node) {
+		for _, attr := range n.Attr {
+			if strings.HasPrefix(attr.Key, "epub:") {
+				this.epub = true
+			}
+		}
+	})
+
+	this.buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!DOCTYPE html>\n")
+	this.renderNode(node)
+	this.buf.WriteByte('\n')
+
+	_, e := w.Write(this.buf.Bytes())
+	return e
+}
+
+// xhtmlSize returns the size of 'node' when it is rendered as XHTML
+func xhtmlSize(node *html.Node) int {
+	this := &xhtmlRenderer{buf: new(bytes.Buffer)}
+	this.renderNode(node)
+	return this.buf.Len()
+}
+
+// parseXhtml parses an XHTML document with the html parser. Self-closing tags
+// of non-void elements are expanded first, otherwise the html parser takes
+// them as start tags, and the following content becomes their children.
+func parseXhtml(data []byte) (*html.Node, error) {
+	data = self_closing_tag.ReplaceAllFunc(data, func(tag []byte) []byte {
+		m := self_closing_tag.FindSubmatch(tag)
+		name := string(m[1])
+		if void_elements[strings.ToLower(name)] {
+			return tag
+		}
+		return []byte("<" + name + string(m[2]) + "></" + name + ">")
+	})
+	return html.Parse(bytes.NewReader(data))
+}
+
+func generateImagePage(path, alt string) []byte {
+	img := newElement(atom.Img,
+		html.Attribute{Key: "alt", Val: alt},
+		html.Attribute{Key: "src", Val: filepath.ToSlash(path)},
+	)
+	p := newElement(atom.P)
+	p.AppendChild(img)
+
+	body := newElement(atom.Body)
+	body.AppendChild(p)
+
+	head := newElement(atom.Head)
+	head.AppendChild(newElement(atom.Title))
+
+	Html := newElement(atom.Html)
+	Html.AppendChild(head)
+	Html.AppendChild(body)
+
+	buf := new(bytes.Buffer)
+	renderXhtml(buf, Html)
+	return buf.Bytes()
+}